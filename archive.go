@@ -0,0 +1,493 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// archiveETagXattr is the extended attribute of the destination directory
+// that records the ETag of the archive extracted into it.
+const archiveETagXattr = "user.s3-sync.archive-etag"
+
+// syncArchive extracts the archive object at the prefix into the destination
+// directory unless the same archive has already been extracted into it.
+func (s *syncer) syncArchive(ctx context.Context) (bool, error) {
+	bucket, key, err := s.resolveLinks(ctx, s.prefix)
+	if err != nil {
+		return false, err
+	}
+	s.resolvedBucket = bucket
+	s.links.prune()
+
+	input := s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}
+	output, err := s.s3Api.HeadObjectWithContext(ctx, &input, s.limiter.requestOptions()...)
+	if err != nil {
+		return false, err
+	}
+	archive := &object{
+		compareKey: path.Base(key),
+		etag:       aws.StringValue(output.ETag),
+		key:        key,
+		modTime:    aws.TimeValue(output.LastModified),
+		size:       aws.Int64Value(output.ContentLength),
+	}
+
+	if err := os.MkdirAll(s.dst, os.ModePerm); err != nil {
+		return false, err
+	}
+
+	etag, err := getXattr(s.dst, archiveETagXattr)
+	if err != nil {
+		return false, err
+	}
+
+	changed := etag == "" || etag != archive.etag
+	if changed {
+		if err := s.extractArchive(ctx, archive); err != nil {
+			return false, err
+		}
+	}
+
+	result := newSyncResult(bucket, key, []*object{archive})
+	if err := s.updateMarker(s.previousResult(), result); err != nil {
+		return false, err
+	}
+	s.result = result
+
+	return changed, nil
+}
+
+// extractArchive extracts the archive into a staging directory next to the
+// destination directory and exchanges them at once, so that the readers never
+// see a mix of the previous and the new archives. A destination directory
+// that is a mount point is updated in place instead.
+func (s *syncer) extractArchive(ctx context.Context, object *object) error {
+	tmp, err := ioutil.TempFile("", "s3-sync")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	log.Printf("Downloading %s...\n", s.location(object.key))
+
+	downloader := s3manager.NewDownloaderWithClient(s.s3Api, s3manager.WithDownloaderRequestOptions(s.limiter.requestOptions()...))
+	if err := s.download(ctx, object, tmp, downloader); err != nil {
+		return err
+	}
+
+	dst := filepath.Clean(s.dst)
+	atomic, err := s.canSwitchRelease()
+	if err != nil {
+		return err
+	}
+	if !atomic {
+		log.Printf("%s is a mount point, which cannot be exchanged with a staging directory, so %s is extracted into it in place, not atomically\n", dst, s.location(object.key))
+		if err := s.extractArchiveInto(ctx, object, tmp, dst); err != nil {
+			return err
+		}
+		return setArchiveETag(dst, object.etag)
+	}
+
+	staging, err := ioutil.TempDir(filepath.Dir(dst), "."+filepath.Base(dst)+".archive")
+	if err != nil {
+		return err
+	}
+	// The staging directory has the previous archive once exchanged.
+	defer os.RemoveAll(staging)
+
+	info, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(staging, info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	if err := s.extractArchiveInto(ctx, object, tmp, staging); err != nil {
+		return err
+	}
+	// The marker in the destination directory is kept until it is rewritten
+	// for the new archive.
+	marker := s.markerPath()
+	if rel, err := filepath.Rel(dst, marker); marker != "" && err == nil && !strings.HasPrefix(rel, "..") {
+		if err := linkMarker(marker, filepath.Join(staging, rel)); err != nil {
+			return err
+		}
+	}
+	if err := setArchiveETag(staging, object.etag); err != nil {
+		return err
+	}
+
+	return exchangeDirs(staging, dst)
+}
+
+// extractArchiveInto extracts the archive downloaded to the file into the
+// directory, and removes the files and the directories not in the archive.
+func (s *syncer) extractArchiveInto(ctx context.Context, object *object, archive *os.File, dir string) error {
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	log.Printf("Extracting %s into %s...\n", s.location(object.key), dir)
+
+	var extracted map[string]bool
+	var err error
+	switch {
+	case strings.HasSuffix(object.key, ".zip"):
+		extracted, err = s.extractZip(dir, archive)
+	case strings.HasSuffix(object.key, ".tar.gz"), strings.HasSuffix(object.key, ".tgz"):
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(archive); err != nil {
+			return err
+		}
+		extracted, err = s.extractTar(dir, r)
+	case strings.HasSuffix(object.key, ".tar"):
+		extracted, err = s.extractTar(dir, archive)
+	default:
+		return fmt.Errorf("unknown archive format of %s", s.location(object.key))
+	}
+	if err != nil {
+		return err
+	}
+
+	d := newLocalDestination(dir, s.markerPath(), false)
+	files, err := d.list(ctx)
+	if err != nil {
+		return err
+	}
+
+	var removed []*file
+	for f := files.next(); f != nil; f = files.next() {
+		if !extracted[f.compareKey] {
+			removed = append(removed, f)
+		}
+	}
+	if err := s.removeFiles(ctx, d, removed); err != nil {
+		return err
+	}
+
+	return pruneArchiveDirs(dir, extracted)
+}
+
+// pruneArchiveDirs removes the empty directories not in the archive, such as
+// those left by the files of the previous archive.
+func pruneArchiveDirs(dir string, extracted map[string]bool) error {
+	var dirs []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || p == dir {
+			return nil
+		}
+		if isSnapshotDir(p) {
+			return filepath.SkipDir
+		}
+		if rel, err := filepath.Rel(dir, p); err != nil {
+			return err
+		} else if !extracted[rel] {
+			dirs = append(dirs, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The subdirectories are removed before their parents.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries, err := ioutil.ReadDir(dirs[i])
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			continue
+		}
+		log.Printf("Removing %s...\n", dirs[i])
+		if err := os.Remove(dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkMarker hard-links the marker into the staging directory, unless it
+// does not exist yet.
+func linkMarker(marker, dst string) error {
+	if _, err := os.Lstat(marker); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Link(marker, dst)
+}
+
+// setArchiveETag records the ETag of the archive extracted into the directory.
+func setArchiveETag(dir, etag string) error {
+	if err := setXattr(dir, archiveETagXattr, etag); xattrUnsupported(err) {
+		return writeXattrSidecar(dir, archiveETagXattr, etag)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *syncer) extractTar(dir string, r io.Reader) (map[string]bool, error) {
+	extracted := make(map[string]bool)
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name, err := archiveEntryName(header.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = s.extractDir(dir, name)
+		case tar.TypeReg, tar.TypeRegA:
+			err = s.extractFile(dir, name, tr, header.FileInfo().Mode(), header.ModTime)
+		case tar.TypeSymlink:
+			err = s.extractSymlink(dir, name, header.Linkname, header.ModTime)
+		case tar.TypeLink:
+			err = s.extractHardLink(dir, name, header.Linkname, extracted)
+		default:
+			log.Printf("Skipping %s of unsupported type %c in the archive\n", header.Name, header.Typeflag)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		extracted[name] = true
+	}
+
+	return extracted, nil
+}
+
+func (s *syncer) extractZip(dir string, file *os.File) (map[string]bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	extracted := make(map[string]bool)
+	for _, f := range zr.File {
+		name, err := archiveEntryName(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue
+		}
+
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = s.extractDir(dir, name)
+		case mode&os.ModeSymlink != 0:
+			err = s.extractZipSymlink(dir, name, f)
+		case mode.IsRegular():
+			err = s.extractZipFile(dir, name, f)
+		default:
+			log.Printf("Skipping %s of unsupported mode %s in the archive\n", f.Name, mode)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		extracted[name] = true
+	}
+
+	return extracted, nil
+}
+
+func (s *syncer) extractZipFile(dir, name string, f *zip.File) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return s.extractFile(dir, name, r, f.Mode(), f.Modified)
+}
+
+func (s *syncer) extractZipSymlink(dir, name string, f *zip.File) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	link, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return s.extractSymlink(dir, name, string(link), f.Modified)
+}
+
+func (s *syncer) extractDir(dir, name string) error {
+	if err := checkArchiveParents(dir, name); err != nil {
+		return err
+	}
+	return os.MkdirAll(filepath.Join(dir, name), os.ModePerm)
+}
+
+// extractFile writes an entry of the archive to a temporary file and renames
+// it into place, in the same way as updateFile.
+func (s *syncer) extractFile(dir, name string, r io.Reader, mode os.FileMode, modTime time.Time) error {
+	dst := filepath.Join(dir, name)
+
+	if err := mkdirArchiveParents(dir, name); err != nil {
+		return err
+	}
+
+	fileName := tempFileName(dst)
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fileName)
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := lchtimes(fileName, modTime); err != nil {
+		return err
+	}
+
+	return os.Rename(fileName, dst)
+}
+
+// extractSymlink creates a symbolic link for an entry of the archive, which
+// must refer to a path in the destination directory.
+func (s *syncer) extractSymlink(dir, name, link string, modTime time.Time) error {
+	dst := filepath.Join(dir, name)
+
+	target := path.Join(path.Dir(filepath.ToSlash(name)), link)
+	if path.IsAbs(link) || target == ".." || strings.HasPrefix(target, "../") {
+		return fmt.Errorf("symbolic link '%s' to '%s' in the archive refers to a path outside %s", name, link, s.dst)
+	}
+
+	if err := mkdirArchiveParents(dir, name); err != nil {
+		return err
+	}
+
+	fileName := tempFileName(dst)
+	if err := os.Symlink(link, fileName); err != nil {
+		return err
+	}
+	defer os.Remove(fileName)
+
+	if err := lchtimes(fileName, modTime); err != nil {
+		return err
+	}
+
+	return os.Rename(fileName, dst)
+}
+
+// extractHardLink creates a hard link for an entry of the archive to another
+// entry extracted before it.
+func (s *syncer) extractHardLink(dir, name, link string, extracted map[string]bool) error {
+	target, err := archiveEntryName(link)
+	if err != nil {
+		return err
+	}
+	if !extracted[target] {
+		return fmt.Errorf("hard link '%s' to '%s' in the archive refers to an entry not extracted before it", name, link)
+	}
+
+	dst := filepath.Join(dir, name)
+	if err := mkdirArchiveParents(dir, name); err != nil {
+		return err
+	}
+
+	fileName := tempFileName(dst)
+	if err := os.Link(filepath.Join(dir, target), fileName); err != nil {
+		return err
+	}
+	defer os.Remove(fileName)
+
+	return os.Rename(fileName, dst)
+}
+
+// mkdirArchiveParents creates the parent directories of an entry of the
+// archive, refusing to go through symbolic links.
+func mkdirArchiveParents(dir, name string) error {
+	if err := checkArchiveParents(dir, name); err != nil {
+		return err
+	}
+	return os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), os.ModePerm)
+}
+
+// checkArchiveParents returns an error if any parent of an entry of the archive
+// in the directory is a symbolic link, which may refer to a path outside it.
+func checkArchiveParents(dir, name string) error {
+	p := dir
+	elems := strings.Split(name, string(filepath.Separator))
+	for _, elem := range elems[:len(elems)-1] {
+		p = filepath.Join(p, elem)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("path '%s' in the archive goes through the symbolic link %s", name, p)
+		}
+	}
+	return nil
+}
+
+// archiveEntryName returns the path of an archive entry relative to the
+// destination directory, refusing entries that would be extracted outside it.
+func archiveEntryName(name string) (string, error) {
+	cleaned := path.Clean(strings.TrimPrefix(name, "/"))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid path '%s' in the archive", name)
+	}
+	if cleaned == "." {
+		return "", nil
+	}
+	return filepath.FromSlash(cleaned), nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+type testTarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+func testTar(t *testing.T, entries []testTarEntry) *bytes.Buffer {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, e := range entries {
+		header := tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.content))}
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &b
+}
+
+func TestExtractHostileTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outside := filepath.Join(dir, "outside")
+	if err := os.Mkdir(outside, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := [][]testTarEntry{
+		{
+			{name: "d", typeflag: tar.TypeSymlink, linkname: outside},
+			{name: "d/x", typeflag: tar.TypeReg, content: "x"},
+		},
+		{
+			{name: "d", typeflag: tar.TypeSymlink, linkname: "../outside"},
+			{name: "d/x", typeflag: tar.TypeReg, content: "x"},
+		},
+		{
+			{name: "a/b", typeflag: tar.TypeSymlink, linkname: "../../outside"},
+		},
+		{
+			{name: "../outside/x", typeflag: tar.TypeReg, content: "x"},
+		},
+		{
+			{name: "x", typeflag: tar.TypeLink, linkname: "../outside/y"},
+		},
+	}
+	for i, entries := range tests {
+		s := &syncer{dst: filepath.Join(dir, "dst")}
+		if err := os.MkdirAll(s.dst, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		// A symbolic link left by a previous archive is not followed either.
+		if err := os.Symlink(outside, filepath.Join(s.dst, "old")); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.extractTar(s.dst, testTar(t, entries)); err == nil {
+			t.Errorf("archive %d: got no error", i)
+		}
+		if _, err := s.extractTar(s.dst, testTar(t, []testTarEntry{{name: "old/x", typeflag: tar.TypeReg, content: "x"}})); err == nil {
+			t.Errorf("archive %d: got no error writing through an existing symbolic link", i)
+		}
+
+		files, err := ioutil.ReadDir(outside)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) > 0 {
+			t.Errorf("archive %d: got %d files written outside the destination", i, len(files))
+		}
+		if err := os.RemoveAll(s.dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExtractTarHardLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &syncer{dst: dir}
+	extracted, err := s.extractTar(s.dst, testTar(t, []testTarEntry{
+		{name: "a", typeflag: tar.TypeReg, content: "a"},
+		{name: "dir/b", typeflag: tar.TypeLink, linkname: "a"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !extracted["a"] || !extracted[filepath.Join("dir", "b")] {
+		t.Errorf("extracted: got %v, want a and dir/b", extracted)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "dir", "b")); err != nil {
+		t.Error(err)
+	} else if string(content) != "a" {
+		t.Errorf("dir/b: got %q, want %q", content, "a")
+	}
+
+	if _, err := s.extractTar(s.dst, testTar(t, []testTarEntry{{name: "c", typeflag: tar.TypeLink, linkname: "missing"}})); err == nil {
+		t.Error("hard link to a missing entry: got no error")
+	}
+}
+
+func TestSyncArchiveStaging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "dst")
+	api := &s3Api{}
+	s := &syncer{bucket: "bucket", prefix: "prefix/archive.tar", dst: dst, marker: "marker.json", archive: true, s3Api: api}
+
+	tests := []struct {
+		entries []testTarEntry
+		etag    string
+		changed bool
+		want    []string
+	}{
+		{
+			entries: []testTarEntry{
+				{name: "a", typeflag: tar.TypeReg, content: "a"},
+				{name: "dir/b", typeflag: tar.TypeReg, content: "b"},
+			},
+			etag:    `"etag1"`,
+			changed: true,
+			want:    []string{"a", "dir", "dir/b", "marker.json"},
+		},
+		{
+			entries: []testTarEntry{{name: "a", typeflag: tar.TypeReg, content: "a"}},
+			etag:    `"etag1"`,
+			changed: false,
+			want:    []string{"a", "dir", "dir/b", "marker.json"},
+		},
+		{
+			// The directory left empty is removed, and the empty one in
+			// the archive is kept.
+			entries: []testTarEntry{
+				{name: "a", typeflag: tar.TypeReg, content: "c"},
+				{name: "empty", typeflag: tar.TypeDir},
+			},
+			etag:    `"etag2"`,
+			changed: true,
+			want:    []string{"a", "empty", "marker.json"},
+		},
+	}
+
+	for i, test := range tests {
+		api.objects = []*testObject{{content: testTar(t, test.entries).String(), etag: test.etag, key: s.prefix, lastModified: time.Now()}}
+		before, _ := os.Stat(dst)
+
+		changed, err := s.sync(context.Background())
+		if err != nil {
+			t.Fatalf("sync %d: %v", i, err)
+		}
+		if changed != test.changed {
+			t.Errorf("sync %d, changed: got %t, want %t", i, changed, test.changed)
+		}
+
+		var got []string
+		err = filepath.Walk(dst, func(p string, info os.FileInfo, err error) error {
+			if err != nil || p == dst || isXattrSidecar(p) {
+				return err
+			}
+			rel, err := filepath.Rel(dst, p)
+			got = append(got, filepath.ToSlash(rel))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("sync %d, files: got %v, want %v", i, got, test.want)
+		}
+
+		// The archive is extracted into a staging directory exchanged with
+		// the destination directory, which is removed afterwards.
+		after, err := os.Stat(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if before != nil && os.SameFile(before, after) == test.changed {
+			t.Errorf("sync %d, exchanged: got %t, want %t", i, !os.SameFile(before, after), test.changed)
+		}
+		if entries, err := ioutil.ReadDir(dir); err != nil {
+			t.Fatal(err)
+		} else if len(entries) != 1 {
+			t.Errorf("sync %d: got %d entries next to the destination directory, want 1", i, len(entries))
+		}
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dst, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "c" {
+		t.Errorf("a: got %q, want %q", content, "c")
+	}
+}
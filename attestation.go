@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	inTotoStatementType   = "https://in-toto.io/Statement/v0.1"
+	inTotoPayloadType     = "application/vnd.in-toto+json"
+	slsaProvenanceType    = "https://slsa.dev/provenance/v0.2"
+	dsseEnvelopeMediaType = "application/vnd.dsse.envelope.v1+json"
+	provenanceBuildType   = "https://github.com/kaorimatz/s3-sync/sync@v1"
+	provenanceBuilderID   = "https://github.com/kaorimatz/s3-sync"
+)
+
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []inTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     slsaProvenance  `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type slsaProvenance struct {
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	BuildType  string `json:"buildType"`
+	Invocation struct {
+		Parameters map[string]interface{} `json:"parameters"`
+	} `json:"invocation"`
+	Metadata struct {
+		BuildStartedOn *time.Time `json:"buildStartedOn,omitempty"`
+		Reproducible   bool       `json:"reproducible"`
+	} `json:"metadata"`
+	Materials []slsaMaterial `json:"materials"`
+}
+
+type slsaMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+// dsseEnvelope is the envelope of an attestation, which is signed only if a
+// signing key is configured.
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     []byte          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   []byte `json:"sig"`
+}
+
+// provenanceStatement returns the in-toto statement of the SLSA provenance
+// of the image with the digest in the repository, whose materials are the
+// synced prefixes.
+func (b *builder) provenanceStatement(repository name.Repository, digest v1.Hash, results []*syncResult, started time.Time) (*inTotoStatement, error) {
+	statement := &inTotoStatement{
+		Type: inTotoStatementType,
+		Subject: []inTotoSubject{
+			{Name: repository.Name(), Digest: map[string]string{digest.Algorithm: digest.Hex}},
+		},
+		PredicateType: slsaProvenanceType,
+	}
+
+	predicate := &statement.Predicate
+	predicate.Builder.ID = provenanceBuilderID + "@" + version
+	predicate.BuildType = provenanceBuildType
+	predicate.Metadata.Reproducible = b.reproducible
+	if !b.reproducible {
+		predicate.Metadata.BuildStartedOn = &started
+	}
+
+	specs := make([]string, 0, len(b.specs))
+	for i, s := range b.specs {
+		spec, err := s.toCSV()
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+
+		if i >= len(results) || results[i] == nil {
+			continue
+		}
+		predicate.Materials = append(predicate.Materials, slsaMaterial{
+			URI:    sourceLocation(s.src, results[i].resolvedBucket, results[i].resolvedPrefix),
+			Digest: map[string]string{"sha256": strings.TrimPrefix(results[i].digest, "sha256:")},
+		})
+	}
+	predicate.Invocation.Parameters = map[string]interface{}{"sync": specs}
+
+	return statement, nil
+}
+
+// pushProvenance pushes the provenance attestation of the image or the image
+// index to each repository of the tags, tagged sha256-<digest>.att.
+func (b *builder) pushProvenance(ctx context.Context, artifact digester, tags []name.Tag, results []*syncResult, started time.Time) error {
+	digest, err := artifact.Digest()
+	if err != nil {
+		return err
+	}
+
+	for _, repository := range repositories(tags) {
+		statement, err := b.provenanceStatement(repository, digest, results, started)
+		if err != nil {
+			return err
+		}
+		payload, err := json.Marshal(statement)
+		if err != nil {
+			return err
+		}
+		envelope, err := b.envelope(inTotoPayloadType, payload)
+		if err != nil {
+			return err
+		}
+
+		annotations := map[string]string{"predicateType": slsaProvenanceType}
+		image, err := newArtifactImage(envelope, dsseEnvelopeMediaType, annotations)
+		if err != nil {
+			return err
+		}
+
+		attTag, err := artifactTag(repository, digest, "att")
+		if err != nil {
+			return err
+		}
+
+		if err := b.pushArtifact(ctx, attTag, image); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *builder) envelope(payloadType string, payload []byte) ([]byte, error) {
+	envelope := dsseEnvelope{PayloadType: payloadType, Payload: payload, Signatures: []dsseSignature{}}
+	if b.signingKey != nil {
+		// The pre-authentication encoding of DSSE is what is signed.
+		pae := fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload)
+		sig, err := sign(b.signingKey, []byte(pae))
+		if err != nil {
+			return nil, err
+		}
+		envelope.Signatures = append(envelope.Signatures, dsseSignature{Sig: sig})
+	}
+	return json.Marshal(&envelope)
+}
+
+// repositories returns the repositories of the tags.
+func repositories(tags []name.Tag) []name.Repository {
+	var repositories []name.Repository
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		if !seen[tag.Context().Name()] {
+			seen[tag.Context().Name()] = true
+			repositories = append(repositories, tag.Context())
+		}
+	}
+	return repositories
+}
+
+// artifactTag returns the tag of the artifact of the kind, such as "att" or
+// "sig", for the image with the digest, following the convention of cosign.
+func artifactTag(repository name.Repository, digest v1.Hash, kind string) (name.Tag, error) {
+	return name.NewTag(fmt.Sprintf("%s:%s-%s.%s", repository.Name(), digest.Algorithm, digest.Hex, kind), name.WeakValidation)
+}
+
+// pushArtifact pushes the artifact image to the tag, or writes it to the OCI
+// image layout.
+func (b *builder) pushArtifact(ctx context.Context, tag name.Tag, image v1.Image) error {
+	if b.output.kind == imageOutputOCI {
+		log.Printf("Writing %s to OCI image layout %s...\n", tag.TagStr(), b.output.path)
+		return writeLayout(b.output.path, image, []name.Tag{tag})
+	}
+
+	log.Printf("Pushing %s...\n", tag)
+	return remote.Write(tag, image, b.remoteOptions(ctx, tag.Context())...)
+}
+
+// artifactImage is an OCI image that consists of a single blob of an
+// arbitrary media type, such as an attestation or a signature.
+type artifactImage struct {
+	config   []byte
+	layer    *blobLayer
+	manifest *v1.Manifest
+}
+
+var _ v1.Image = (*artifactImage)(nil)
+
+func newArtifactImage(data []byte, mediaType types.MediaType, annotations map[string]string) (*artifactImage, error) {
+	layer := newBlobLayer(data, mediaType)
+
+	config, err := json.Marshal(&v1.ConfigFile{
+		RootFS: v1.RootFS{Type: "layers", DiffIDs: []v1.Hash{layer.digest}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	configDigest, _, err := v1.SHA256(bytes.NewReader(config))
+	if err != nil {
+		return nil, err
+	}
+
+	return &artifactImage{
+		config: config,
+		layer:  layer,
+		manifest: &v1.Manifest{
+			SchemaVersion: 2,
+			MediaType:     types.OCIManifestSchema1,
+			Config: v1.Descriptor{
+				MediaType: types.OCIConfigJSON,
+				Size:      int64(len(config)),
+				Digest:    configDigest,
+			},
+			Layers: []v1.Descriptor{{
+				MediaType:   mediaType,
+				Size:        int64(len(data)),
+				Digest:      layer.digest,
+				Annotations: annotations,
+			}},
+		},
+	}, nil
+}
+
+// Layers implements v1.Image
+func (i *artifactImage) Layers() ([]v1.Layer, error) {
+	return []v1.Layer{i.layer}, nil
+}
+
+// MediaType implements v1.Image
+func (i *artifactImage) MediaType() (types.MediaType, error) {
+	return i.manifest.MediaType, nil
+}
+
+// ConfigName implements v1.Image
+func (i *artifactImage) ConfigName() (v1.Hash, error) {
+	return i.manifest.Config.Digest, nil
+}
+
+// ConfigFile implements v1.Image
+func (i *artifactImage) ConfigFile() (*v1.ConfigFile, error) {
+	return partial.ConfigFile(i)
+}
+
+// RawConfigFile implements v1.Image
+func (i *artifactImage) RawConfigFile() ([]byte, error) {
+	return i.config, nil
+}
+
+// Digest implements v1.Image
+func (i *artifactImage) Digest() (v1.Hash, error) {
+	return partial.Digest(i)
+}
+
+// Manifest implements v1.Image
+func (i *artifactImage) Manifest() (*v1.Manifest, error) {
+	return i.manifest, nil
+}
+
+// RawManifest implements v1.Image
+func (i *artifactImage) RawManifest() ([]byte, error) {
+	return json.Marshal(i.manifest)
+}
+
+// LayerByDigest implements v1.Image
+func (i *artifactImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	if h == i.layer.digest {
+		return i.layer, nil
+	}
+	if h == i.manifest.Config.Digest {
+		return partial.ConfigLayer(i)
+	}
+	return nil, fmt.Errorf("blob %s not found in the artifact", h)
+}
+
+// LayerByDiffID implements v1.Image
+func (i *artifactImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	return i.LayerByDigest(h)
+}
+
+// blobLayer is a layer of an uncompressed blob held in memory.
+type blobLayer struct {
+	data      []byte
+	digest    v1.Hash
+	mediaType types.MediaType
+}
+
+func newBlobLayer(data []byte, mediaType types.MediaType) *blobLayer {
+	digest, _, _ := v1.SHA256(bytes.NewReader(data))
+	return &blobLayer{data: data, digest: digest, mediaType: mediaType}
+}
+
+// Digest implements v1.Layer
+func (l *blobLayer) Digest() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+// DiffID implements v1.Layer
+func (l *blobLayer) DiffID() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+// Compressed implements v1.Layer
+func (l *blobLayer) Compressed() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(l.data)), nil
+}
+
+// Uncompressed implements v1.Layer
+func (l *blobLayer) Uncompressed() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(l.data)), nil
+}
+
+// Size implements v1.Layer
+func (l *blobLayer) Size() (int64, error) {
+	return int64(len(l.data)), nil
+}
+
+// MediaType implements v1.Layer
+func (l *blobLayer) MediaType() (types.MediaType, error) {
+	return l.mediaType, nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+const (
+	registryAuthProviderGCP   = "gcp"
+	registryAuthProviderAzure = "azure"
+)
+
+// newRegistryAuthenticator returns the authenticator for the explicitly
+// configured credentials of a registry.
+func newRegistryAuthenticator(spec *registryAuthSpec) (authenticator, error) {
+	switch {
+	case spec.usernameFile != "" || spec.passwordFile != "":
+		return &fileAuthenticator{usernameFile: spec.usernameFile, passwordFile: spec.passwordFile}, nil
+	case spec.tokenFile != "":
+		return &fileAuthenticator{tokenFile: spec.tokenFile}, nil
+	case spec.helper != "":
+		return &helperAuthenticator{helper: spec.helper, registry: spec.registry}, nil
+	case spec.provider == registryAuthProviderGCP:
+		return &tokenExchangeAuthenticator{exchange: gcpAccessToken}, nil
+	case spec.provider == registryAuthProviderAzure:
+		return &tokenExchangeAuthenticator{exchange: func(ctx context.Context) (*authn.Basic, time.Time, error) {
+			return acrRefreshToken(ctx, spec.registry)
+		}}, nil
+	default:
+		return nil, fmt.Errorf("no credentials configured for registry %s", spec.registry)
+	}
+}
+
+// fileAuthenticator reads the credentials from files on every authorization,
+// so that rotated credentials are picked up without a restart. A token is an
+// OAuth2 refresh token, such as the identity token of a Docker config.
+type fileAuthenticator struct {
+	usernameFile string
+	passwordFile string
+	tokenFile    string
+}
+
+func (a *fileAuthenticator) authorization(ctx context.Context) (string, error) {
+	if a.tokenFile != "" {
+		token, err := readCredentialFile(a.tokenFile)
+		if err != nil {
+			return "", err
+		}
+		// The registries with a Basic challenge take the token as the
+		// password, as the Docker credential helpers return it.
+		return (&authn.Basic{Username: "<token>", Password: token}).Authorization()
+	}
+
+	username, err := readCredentialFile(a.usernameFile)
+	if err != nil {
+		return "", err
+	}
+	password, err := readCredentialFile(a.passwordFile)
+	if err != nil {
+		return "", err
+	}
+	return (&authn.Basic{Username: username, Password: password}).Authorization()
+}
+
+// wrapTransport exchanges the refresh token for access tokens at the token
+// realms of the registries.
+func (a *fileAuthenticator) wrapTransport(inner http.RoundTripper) http.RoundTripper {
+	if a.tokenFile == "" {
+		return inner
+	}
+	return &refreshTokenTransport{
+		inner:  inner,
+		token:  func() (string, error) { return readCredentialFile(a.tokenFile) },
+		realms: make(map[string]bool),
+	}
+}
+
+func readCredentialFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// helperAuthenticator gets the credentials from a Docker credential helper.
+type helperAuthenticator struct {
+	helper   string
+	registry string
+}
+
+func (a *helperAuthenticator) authorization(ctx context.Context) (string, error) {
+	name := "docker-credential-" + a.helper
+
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, "get")
+	cmd.Stdin = strings.NewReader(a.registry)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error invoking %s: %v", name, err)
+	}
+
+	var output struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return "", fmt.Errorf("error parsing the output of %s: %v", name, err)
+	}
+
+	return (&authn.Basic{Username: output.Username, Password: output.Secret}).Authorization()
+}
+
+// tokenExchangeAuthenticator caches the credentials obtained by exchanging a
+// token of a cloud provider until they are about to expire.
+type tokenExchangeAuthenticator struct {
+	basic       *authn.Basic
+	exchange    func(ctx context.Context) (*authn.Basic, time.Time, error)
+	mutex       sync.Mutex
+	validBefore time.Time
+}
+
+func (a *tokenExchangeAuthenticator) authorization(ctx context.Context) (string, error) {
+	basic, err := a.credentials(ctx)
+	if err != nil {
+		return "", err
+	}
+	return basic.Authorization()
+}
+
+// credentials returns the cached credentials, exchanging the token again if
+// they are about to expire.
+func (a *tokenExchangeAuthenticator) credentials(ctx context.Context) (*authn.Basic, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.basic != nil && time.Now().Before(a.validBefore) {
+		return a.basic, nil
+	}
+
+	basic, expiresAt, err := a.exchange(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	a.basic = basic
+	a.validBefore = expiresAt.Add(-1 * expiresAt.Sub(time.Now()) / time.Duration(2))
+
+	return a.basic, nil
+}
+
+// errNoMetadataServer is returned when there are no credentials to get from
+// the metadata server, as its host name is not resolved outside the cloud.
+var errNoMetadataServer = errors.New("no metadata server to get access token from")
+
+// isHostNotFound reports whether the error of an HTTP request is that the host
+// name of the URL is not resolved, as opposed to a temporary failure.
+func isHostNotFound(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*net.OpError); ok {
+		err = e.Err
+	}
+	e, ok := err.(*net.DNSError)
+	return ok && !e.Temporary()
+}
+
+var (
+	gcpMetadataTokenURL   = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	azureMetadataTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https%3A%2F%2Fmanagement.azure.com%2F"
+)
+
+// gcpAccessToken returns the credentials for Google Container Registry and
+// Artifact Registry, using the access token of the service account of the
+// instance obtained from the metadata server.
+func gcpAccessToken(ctx context.Context) (*authn.Basic, time.Time, error) {
+	req, err := http.NewRequest(http.MethodGet, gcpMetadataTokenURL, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := doJSONRequest(ctx, req, &token); err != nil {
+		if isHostNotFound(err) {
+			return nil, time.Time{}, errNoMetadataServer
+		}
+		return nil, time.Time{}, fmt.Errorf("error getting access token from the metadata server: %v", err)
+	}
+
+	basic := &authn.Basic{Username: "oauth2accesstoken", Password: token.AccessToken}
+	return basic, time.Now().Add(time.Duration(token.ExpiresIn) * time.Second), nil
+}
+
+// acrRefreshToken returns the credentials for Azure Container Registry, by
+// exchanging the access token of the managed identity of the instance for a
+// refresh token of the registry.
+func acrRefreshToken(ctx context.Context, registry string) (*authn.Basic, time.Time, error) {
+	req, err := http.NewRequest(http.MethodGet, azureMetadataTokenURL, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := doJSONRequest(ctx, req, &token); err != nil {
+		return nil, time.Time{}, fmt.Errorf("error getting access token from the metadata server: %v", err)
+	}
+
+	expiresOn, err := strconv.ParseInt(token.ExpiresOn, 10, 64)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid expiry of access token: %v", err)
+	}
+
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {registry},
+		"access_token": {token.AccessToken},
+	}
+	req, err = http.NewRequest(http.MethodPost, "https://"+registry+"/oauth2/exchange", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var exchange struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := doJSONRequest(ctx, req, &exchange); err != nil {
+		return nil, time.Time{}, fmt.Errorf("error exchanging access token for refresh token: %v", err)
+	}
+
+	// The refresh token is valid as long as the access token it was
+	// exchanged for.
+	basic := &authn.Basic{Username: "00000000-0000-0000-0000-000000000000", Password: exchange.RefreshToken}
+	return basic, time.Unix(expiresOn, 0), nil
+}
+
+// transportWrapper is an authenticator that needs more than the Authorization
+// header to authenticate to the registries.
+type transportWrapper interface {
+	wrapTransport(inner http.RoundTripper) http.RoundTripper
+}
+
+// remoteOptions returns the options of the registry client to authenticate
+// with the authenticator.
+func remoteOptions(ctx context.Context, a authenticator) []remote.Option {
+	options := []remote.Option{remote.WithAuth(authnAuthenticatorFunc(func() (string, error) { return a.authorization(ctx) }))}
+	if w, ok := a.(transportWrapper); ok {
+		options = append(options, remote.WithTransport(w.wrapTransport(http.DefaultTransport)))
+	}
+	return options
+}
+
+var bearerRealmRegexp = regexp.MustCompile(`(?i)\ABearer\s.*\brealm="([^"]+)"`)
+
+// refreshTokenTransport sends the refresh token to the token realms of the
+// registries with the OAuth2 refresh token grant, in place of the GET requests
+// with Basic credentials sent by the registry client. The realms are learned
+// from the Bearer challenges of the registries.
+type refreshTokenTransport struct {
+	inner  http.RoundTripper
+	token  func() (string, error)
+	mutex  sync.Mutex
+	realms map[string]bool
+}
+
+func (t *refreshTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet && t.isRealm(req.URL) {
+		return t.exchange(req)
+	}
+
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		if m := bearerRealmRegexp.FindStringSubmatch(resp.Header.Get("WWW-Authenticate")); m != nil {
+			if u, err := url.Parse(m[1]); err == nil {
+				t.mutex.Lock()
+				t.realms[realmKey(u)] = true
+				t.mutex.Unlock()
+			}
+		}
+	}
+	return resp, nil
+}
+
+func (t *refreshTokenTransport) isRealm(u *url.URL) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.realms[realmKey(u)]
+}
+
+// exchange posts the refresh token with the service and the scopes of the GET
+// request for an access token to the realm.
+func (t *refreshTokenTransport) exchange(req *http.Request) (*http.Response, error) {
+	token, err := t.token()
+	if err != nil {
+		return nil, err
+	}
+
+	query := req.URL.Query()
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {token},
+		"client_id":     {"s3-sync"},
+		"service":       {query.Get("service")},
+		"scope":         {strings.Join(query["scope"], " ")},
+	}
+	u := *req.URL
+	u.RawQuery = ""
+	post, err := http.NewRequest(http.MethodPost, u.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	post.Header.Set("User-Agent", req.Header.Get("User-Agent"))
+
+	return t.inner.RoundTrip(post.WithContext(req.Context()))
+}
+
+func realmKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+func doJSONRequest(ctx context.Context, req *http.Request, v interface{}) error {
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, body)
+	}
+
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestRegistryAuthValueSet(t *testing.T) {
+	valid := []string{
+		"registry=ghcr.io,username-file=/username,password-file=/password",
+		"registry=ghcr.io,token-file=/token",
+		"registry=harbor.example.com,helper=harbor",
+		"registry=gcr.io,provider=gcp",
+	}
+	for _, s := range valid {
+		var v registryAuthValue
+		if err := v.Set(s); err != nil {
+			t.Errorf("Set(%q): unexpected error: %v", s, err)
+		}
+	}
+
+	var v registryAuthValue
+	if err := v.Set("registry=Docker.io,token-file=/token"); err != nil {
+		t.Fatal(err)
+	}
+	if registry := v.specs[0].registry; registry != "index.docker.io" {
+		t.Errorf("registry: got %q, want %q", registry, "index.docker.io")
+	}
+
+	invalid := []string{
+		"username-file=/username,password-file=/password",
+		"registry=ghcr.io,username-file=/username",
+		"registry=ghcr.io,token-file=/token,helper=ghcr",
+		"registry=ghcr.io,provider=aws",
+		"registry=ghcr.io",
+	}
+	for _, s := range invalid {
+		var v registryAuthValue
+		if err := v.Set(s); err == nil {
+			t.Errorf("Set(%q): expected an error", s)
+		}
+	}
+}
+
+func TestFileAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{"username": "user\n", "password": "pass\n"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := &fileAuthenticator{usernameFile: filepath.Join(dir, "username"), passwordFile: filepath.Join(dir, "password")}
+	auth, err := a.authorization(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass")); auth != expected {
+		t.Errorf("authorization: got %q, want %q", auth, expected)
+	}
+}
+
+func TestGCPAccessToken(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	url := gcpMetadataTokenURL
+	gcpMetadataTokenURL = server.URL
+	defer func() { gcpMetadataTokenURL = url }()
+
+	a := &tokenExchangeAuthenticator{exchange: gcpAccessToken}
+	for i := 0; i < 2; i++ {
+		auth, err := a.authorization(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("oauth2accesstoken:token")); auth != expected {
+			t.Errorf("authorization: got %q, want %q", auth, expected)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("requests: got %d, want 1", requests)
+	}
+}
+
+func TestFileAuthenticatorRefreshToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("refresh\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if r.Method != http.MethodPost || r.PostFormValue("grant_type") != "refresh_token" || r.PostFormValue("refresh_token") != "refresh" || r.PostFormValue("scope") != "repository:repo:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"access_token":"access"}`))
+		default:
+			if r.Header.Get("Authorization") != "Bearer access" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"name":"repo","tags":["tag"]}`))
+		}
+	}))
+	defer server.Close()
+
+	repository, err := name.NewRepository(strings.TrimPrefix(server.URL, "http://")+"/repo", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &fileAuthenticator{tokenFile: tokenFile}
+	tags, err := remote.List(repository, remoteOptions(context.Background(), a)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0] != "tag" {
+		t.Errorf("tags: got %v, want [tag]", tags)
+	}
+}
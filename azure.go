@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// azureVersion is the version of the Azure Blob Storage REST API.
+const azureVersion = "2019-12-12"
+
+// azureContainer returns the container of the az://account/container/prefix
+// URL.
+func azureContainer(u *url.URL) string {
+	return strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)[0]
+}
+
+// azureSource is a container of Azure Blob Storage. The blobs are read with the
+// SAS token in the AZURE_STORAGE_SAS_TOKEN environment variable, or
+// anonymously if it is not set.
+type azureSource struct {
+	container string
+	endpoint  string
+	sasToken  string
+	limiter   *rateLimiter
+}
+
+func newAzureSource(account, container string, limiter *rateLimiter) *azureSource {
+	return &azureSource{
+		container: container,
+		endpoint:  fmt.Sprintf("https://%s.blob.core.windows.net", account),
+		sasToken:  strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?"),
+		limiter:   limiter,
+	}
+}
+
+type azureBlobs struct {
+	Blobs struct {
+		Blob []struct {
+			Name       string `xml:"Name"`
+			Properties struct {
+				LastModified  string `xml:"Last-Modified"`
+				ETag          string `xml:"Etag"`
+				ContentLength int64  `xml:"Content-Length"`
+			} `xml:"Properties"`
+		} `xml:"Blob"`
+	} `xml:"Blobs"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func (s *azureSource) list(ctx context.Context, prefix string) ([]*object, error) {
+	var objects []*object
+	var marker string
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+
+		resp, err := s.get(ctx, "/"+url.PathEscape(s.container), query)
+		if err != nil {
+			return nil, err
+		}
+		var page azureBlobs
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error listing blobs in %s: %v", s.container, err)
+		}
+
+		for _, blob := range page.Blobs.Blob {
+			modTime, err := http.ParseTime(blob.Properties.LastModified)
+			if err != nil {
+				return nil, fmt.Errorf("invalid modification time of %s: %v", blob.Name, err)
+			}
+			objects = append(objects, &object{
+				etag:    blob.Properties.ETag,
+				key:     blob.Name,
+				modTime: modTime,
+				size:    blob.Properties.ContentLength,
+			})
+		}
+
+		if page.NextMarker == "" {
+			return objects, nil
+		}
+		marker = page.NextMarker
+	}
+}
+
+func (s *azureSource) open(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	elements := strings.Split(key, "/")
+	for i, e := range elements {
+		elements[i] = url.PathEscape(e)
+	}
+
+	resp, err := s.get(ctx, "/"+url.PathEscape(s.container)+"/"+strings.Join(elements, "/"), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Body, resp.Header.Get("Content-Encoding"), nil
+}
+
+func (s *azureSource) readLink(ctx context.Context, key string) (string, error) {
+	return readLink(ctx, s, s.limiter, key)
+}
+
+func (s *azureSource) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	rawQuery := query.Encode()
+	if s.sasToken != "" {
+		if rawQuery != "" {
+			rawQuery += "&"
+		}
+		rawQuery += s.sasToken
+	}
+	u := s.endpoint + path
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", azureVersion)
+	// Prevent the HTTP transport from transparently decompressing the blobs
+	// stored with Content-Encoding: gzip.
+	req.Header.Set("Accept-Encoding", "identity")
+
+	return getHTTP(ctx, s.limiter, req)
+}
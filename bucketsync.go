@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3DestinationScheme is the prefix of the destinations that are prefixes in
+// another S3 bucket instead of directories.
+const s3DestinationScheme = "s3://"
+
+// maxDeleteObjects is the maximum number of keys in a DeleteObjects request.
+const maxDeleteObjects = 1000
+
+var (
+	// maxCopyObjectSize is the size of the largest object copied with a
+	// single CopyObject request. Larger objects are copied in parts.
+	maxCopyObjectSize int64 = 5 << 30
+	// copyPartSize is the minimum size of the parts of the objects copied in
+	// parts, which is increased for the objects larger than the max number
+	// of parts of this size.
+	copyPartSize int64 = 512 << 20
+	// uploadPartSize is the size of the parts of the objects uploaded from
+	// the sources other than S3, whose sizes are unknown until they are
+	// downloaded. The objects up to s3manager.MaxUploadParts parts of this
+	// size can be uploaded, and as many parts as the concurrency of the
+	// upload are held in memory.
+	uploadPartSize int64 = 32 << 20
+)
+
+func isS3Destination(dst string) bool {
+	return strings.HasPrefix(dst, s3DestinationScheme)
+}
+
+// parseS3URL returns the bucket and the key of the s3://bucket/key URL.
+func parseS3URL(u string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(u, s3DestinationScheme), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// syncBucket mirrors the objects into another S3 bucket. The objects in the
+// source bucket are copied server-side, so nothing is written to the local
+// disk.
+func (s *syncer) syncBucket(ctx context.Context) (bool, error) {
+	bucket, prefix := parseS3URL(s.dst)
+	d := newS3Destination(bucket, prefix, s.limiter, s.dstS3Api)
+
+	resolvedPrefix, objects, changed, err := s.syncTo(ctx, d)
+	if err != nil {
+		return false, err
+	}
+
+	s.result = newSyncResult(s.resolvedBucket, resolvedPrefix, objects.objects)
+
+	return changed, nil
+}
+
+// s3Destination is a prefix in an S3 bucket.
+type s3Destination struct {
+	bucket  string
+	prefix  string
+	limiter *rateLimiter
+	s3Api   s3iface.S3API
+}
+
+func newS3Destination(bucket, prefix string, limiter *rateLimiter, s3Api s3iface.S3API) *s3Destination {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &s3Destination{bucket: bucket, prefix: prefix, limiter: limiter, s3Api: s3Api}
+}
+
+func (d *s3Destination) list(ctx context.Context) (*fileIterator, error) {
+	var files []*file
+	input := s3.ListObjectsV2Input{Bucket: aws.String(d.bucket), Prefix: aws.String(d.prefix)}
+	err := d.s3Api.ListObjectsV2PagesWithContext(ctx, &input, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range output.Contents {
+			key := aws.StringValue(o.Key)
+			files = append(files, &file{
+				compareKey: strings.TrimPrefix(key, d.prefix),
+				etag:       aws.StringValue(o.ETag),
+				modTime:    aws.TimeValue(o.LastModified),
+				path:       key,
+				size:       aws.Int64Value(o.Size),
+			})
+		}
+		return true
+	}, d.limiter.requestOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	return &fileIterator{files: files}, nil
+}
+
+// put uploads the object downloaded from a source other than S3 while it is
+// downloaded, through a pipe to the uploader. The ETag is not recorded, as the
+// objects are compared by their sizes and modification times.
+func (d *s3Destination) put(ctx context.Context, key string, size int64, modTime time.Time, etag string, write func(downloadFile) error) error {
+	r, w := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		err := write(&streamFile{w: w})
+		w.CloseWithError(err)
+		errCh <- err
+	}()
+
+	uploader := s3manager.NewUploaderWithClient(d.s3Api, s3manager.WithUploaderRequestOptions(d.limiter.requestOptions()...))
+	uploader.PartSize = uploadPartSize
+	input := s3manager.UploadInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(d.prefix + key),
+		Body:   r,
+	}
+	_, err := uploader.UploadWithContext(ctx, &input)
+	// Stop the download if the upload failed.
+	r.Close()
+
+	if writeErr := <-errCh; writeErr != nil && writeErr != io.ErrClosedPipe {
+		return writeErr
+	}
+	return err
+}
+
+func (d *s3Destination) symlink(ctx context.Context, key, target string, modTime time.Time) error {
+	return fmt.Errorf("cannot create a symbolic link at %s", d.location(key))
+}
+
+func (d *s3Destination) delete(ctx context.Context, key string) error {
+	return d.deleteAll(ctx, []string{key})
+}
+
+// deleteAll deletes the objects at the keys in batches.
+func (d *s3Destination) deleteAll(ctx context.Context, keys []string) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxDeleteObjects {
+			n = maxDeleteObjects
+		}
+
+		var objects []*s3.ObjectIdentifier
+		for _, key := range keys[:n] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(d.prefix + key)})
+		}
+		input := s3.DeleteObjectsInput{
+			Bucket: aws.String(d.bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		}
+		output, err := d.s3Api.DeleteObjectsWithContext(ctx, &input, d.limiter.requestOptions()...)
+		if err != nil {
+			return err
+		}
+		if len(output.Errors) > 0 {
+			e := output.Errors[0]
+			return fmt.Errorf("error deleting %s: %s", d.location(strings.TrimPrefix(aws.StringValue(e.Key), d.prefix)), aws.StringValue(e.Message))
+		}
+
+		keys = keys[n:]
+	}
+	return nil
+}
+
+func (d *s3Destination) location(key string) string {
+	return fmt.Sprintf("s3://%s/%s", d.bucket, d.prefix+key)
+}
+
+// copy copies the object from the source bucket server-side, in parts if it
+// is too large for a single CopyObject request.
+func (d *s3Destination) copy(ctx context.Context, key, bucket string, object *object) error {
+	source := copySource(bucket, object.key)
+	if object.size <= maxCopyObjectSize {
+		input := s3.CopyObjectInput{
+			Bucket:     aws.String(d.bucket),
+			Key:        aws.String(d.prefix + key),
+			CopySource: aws.String(source),
+		}
+		_, err := d.s3Api.CopyObjectWithContext(ctx, &input, d.limiter.requestOptions()...)
+		return err
+	}
+
+	// Unlike CopyObject, the multipart upload does not copy the metadata
+	// of the object.
+	headInput := s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(object.key)}
+	head, err := d.s3Api.HeadObjectWithContext(ctx, &headInput, d.limiter.requestOptions()...)
+	if err != nil {
+		return err
+	}
+
+	createInput := s3.CreateMultipartUploadInput{
+		Bucket:             aws.String(d.bucket),
+		Key:                aws.String(d.prefix + key),
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentEncoding:    head.ContentEncoding,
+		ContentLanguage:    head.ContentLanguage,
+		ContentType:        head.ContentType,
+		Metadata:           head.Metadata,
+	}
+	upload, err := d.s3Api.CreateMultipartUploadWithContext(ctx, &createInput, d.limiter.requestOptions()...)
+	if err != nil {
+		return err
+	}
+
+	parts, err := d.copyParts(ctx, upload.UploadId, key, source, object.size)
+	if err != nil {
+		abortInput := s3.AbortMultipartUploadInput{Bucket: aws.String(d.bucket), Key: aws.String(d.prefix + key), UploadId: upload.UploadId}
+		if _, e := d.s3Api.AbortMultipartUploadWithContext(ctx, &abortInput, d.limiter.requestOptions()...); e != nil {
+			log.Printf("Error aborting the upload of %s: %v\n", d.location(key), e)
+		}
+		return err
+	}
+
+	completeInput := s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(d.bucket),
+		Key:             aws.String(d.prefix + key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	}
+	_, err = d.s3Api.CompleteMultipartUploadWithContext(ctx, &completeInput, d.limiter.requestOptions()...)
+	return err
+}
+
+func (d *s3Destination) copyParts(ctx context.Context, uploadID *string, key, source string, size int64) ([]*s3.CompletedPart, error) {
+	partSize := copyPartSize
+	if min := (size + s3manager.MaxUploadParts - 1) / s3manager.MaxUploadParts; min > partSize {
+		partSize = min
+	}
+
+	var parts []*s3.CompletedPart
+	for offset, number := int64(0), int64(1); offset < size; offset, number = offset+partSize, number+1 {
+		end := offset + partSize
+		if end > size {
+			end = size
+		}
+
+		input := s3.UploadPartCopyInput{
+			Bucket:          aws.String(d.bucket),
+			Key:             aws.String(d.prefix + key),
+			UploadId:        uploadID,
+			PartNumber:      aws.Int64(number),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end-1)),
+		}
+		output, err := d.s3Api.UploadPartCopyWithContext(ctx, &input, d.limiter.requestOptions()...)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: output.CopyPartResult.ETag, PartNumber: aws.Int64(number)})
+	}
+	return parts, nil
+}
+
+// copySource returns the URL-encoded source of the CopyObject and the
+// UploadPartCopy requests.
+func copySource(bucket, key string) string {
+	elements := strings.Split(bucket+"/"+key, "/")
+	for i, e := range elements {
+		elements[i] = strings.Replace(url.QueryEscape(e), "+", "%20", -1)
+	}
+	return strings.Join(elements, "/")
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// bucketApi is an S3 API serving multiple buckets in memory.
+type bucketApi struct {
+	s3iface.S3API
+	buckets map[string]map[string]*testObject
+	parts   map[int64]string
+	copies  []string
+	// reads is the number of the objects read by GetObject.
+	reads int32
+}
+
+func (a *bucketApi) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error {
+	var keys []string
+	for key := range a.buckets[aws.StringValue(input.Bucket)] {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	output := s3.ListObjectsV2Output{}
+	for _, key := range keys {
+		o := a.buckets[aws.StringValue(input.Bucket)][key]
+		output.Contents = append(output.Contents, &s3.Object{
+			Key:          aws.String(key),
+			LastModified: aws.Time(o.lastModified),
+			Size:         aws.Int64(o.size()),
+		})
+		if o.etag != "" {
+			output.Contents[len(output.Contents)-1].ETag = aws.String(o.etag)
+		}
+	}
+	fn(&output, true)
+	return nil
+}
+
+// GetObjectWithContext returns the object at the key, or at the key followed by
+// ?versionId= and the version ID if specified, unless it has the ETag in
+// If-None-Match.
+func (a *bucketApi) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	key := aws.StringValue(input.Key)
+	if input.VersionId != nil {
+		key += "?versionId=" + aws.StringValue(input.VersionId)
+	}
+	o, ok := a.buckets[aws.StringValue(input.Bucket)][key]
+	if !ok {
+		return nil, fmt.Errorf("object not found. key=%s", key)
+	}
+	if o.etag != "" && aws.StringValue(input.IfNoneMatch) == o.etag {
+		return nil, awserr.NewRequestFailure(awserr.New("NotModified", "Not Modified", nil), http.StatusNotModified, "")
+	}
+	atomic.AddInt32(&a.reads, 1)
+	output := s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(o.content)), ContentLength: aws.Int64(o.size())}
+	if o.etag != "" {
+		output.ETag = aws.String(o.etag)
+	}
+	return &output, nil
+}
+
+func (a *bucketApi) source(copySource string) (*testObject, error) {
+	parts := strings.SplitN(copySource, "/", 2)
+	key, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	o, ok := a.buckets[parts[0]][key]
+	if !ok {
+		return nil, fmt.Errorf("object not found. key=%s", key)
+	}
+	return o, nil
+}
+
+func (a *bucketApi) put(bucket, key, content string) {
+	if a.buckets[bucket] == nil {
+		a.buckets[bucket] = make(map[string]*testObject)
+	}
+	a.buckets[bucket][key] = &testObject{content: content, key: key, lastModified: time.Now()}
+}
+
+func (a *bucketApi) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	o, err := a.source(aws.StringValue(input.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	a.copies = append(a.copies, aws.StringValue(input.CopySource))
+	a.put(aws.StringValue(input.Bucket), aws.StringValue(input.Key), o.content)
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (a *bucketApi) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	return &s3.HeadObjectOutput{ContentType: aws.String("text/plain")}, nil
+}
+
+func (a *bucketApi) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	a.parts = make(map[int64]string)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload")}, nil
+}
+
+func (a *bucketApi) UploadPartCopyWithContext(ctx aws.Context, input *s3.UploadPartCopyInput, opts ...request.Option) (*s3.UploadPartCopyOutput, error) {
+	o, err := a.source(aws.StringValue(input.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	var start, end int
+	if _, err := fmt.Sscanf(aws.StringValue(input.CopySourceRange), "bytes=%d-%d", &start, &end); err != nil {
+		return nil, err
+	}
+	number := aws.Int64Value(input.PartNumber)
+	a.parts[number] = o.content[start : end+1]
+	etag := fmt.Sprintf("part%d", number)
+	return &s3.UploadPartCopyOutput{CopyPartResult: &s3.CopyPartResult{ETag: aws.String(etag)}}, nil
+}
+
+// PutObjectRequest returns the request putting the object when it is sent.
+func (a *bucketApi) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	output := &s3.PutObjectOutput{}
+	req := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, &request.Operation{Name: "PutObject"}, input, output)
+	req.Handlers.Send.PushBack(func(r *request.Request) {
+		content, err := ioutil.ReadAll(input.Body)
+		if err != nil {
+			r.Error = err
+			return
+		}
+		a.put(aws.StringValue(input.Bucket), aws.StringValue(input.Key), string(content))
+	})
+	return req, output
+}
+
+func (a *bucketApi) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	var content string
+	for _, p := range input.MultipartUpload.Parts {
+		content += a.parts[aws.Int64Value(p.PartNumber)]
+	}
+	a.copies = append(a.copies, "multipart:"+aws.StringValue(input.Key))
+	a.put(aws.StringValue(input.Bucket), aws.StringValue(input.Key), content)
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (a *bucketApi) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	for _, o := range input.Delete.Objects {
+		delete(a.buckets[aws.StringValue(input.Bucket)], aws.StringValue(o.Key))
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+func TestSyncBucket(t *testing.T) {
+	defer func(size, partSize int64) { maxCopyObjectSize, copyPartSize = size, partSize }(maxCopyObjectSize, copyPartSize)
+	maxCopyObjectSize, copyPartSize = 4, 2
+
+	modTime := time.Now().Add(-time.Hour)
+	api := &bucketApi{buckets: map[string]map[string]*testObject{
+		"src": {
+			"prefix/key 1": {content: "a", lastModified: modTime},
+			"prefix/key2":  {content: "bbbbb", lastModified: modTime},
+		},
+		"dst": {
+			"mirror/key3": {content: "c", lastModified: modTime},
+			"other/key4":  {content: "d", lastModified: modTime},
+		},
+	}}
+	s := &syncer{
+		bucket:   "src",
+		prefix:   "prefix",
+		dst:      "s3://dst/mirror",
+		limiter:  newRateLimiter(nil, 0, 0),
+		s3Api:    api,
+		dstS3Api: api,
+	}
+
+	changed, err := s.sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("first sync: got unchanged")
+	}
+
+	got := make(map[string]string)
+	for key, o := range api.buckets["dst"] {
+		got[key] = o.content
+	}
+	want := map[string]string{"mirror/key 1": "a", "mirror/key2": "bbbbb", "other/key4": "d"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("files: got %v, want %v", got, want)
+	}
+	wantCopies := []string{"src/prefix/key%201", "multipart:mirror/key2"}
+	if !reflect.DeepEqual(api.copies, wantCopies) {
+		t.Errorf("copies: got %v, want %v", api.copies, wantCopies)
+	}
+
+	api.copies = nil
+	if changed, err := s.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if changed || len(api.copies) > 0 {
+		t.Errorf("second sync: got changed %t and copies %v", changed, api.copies)
+	}
+}
+
+func TestSyncBucketFromHTTPIndexSource(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/index.json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"objects": [
+			{"key": "key1", "size": 1, "lastModified": "2019-01-02T03:04:05Z", "etag": "0cc175b9c0f1b6a831c399e269772661"},
+			{"key": "key2", "size": 1, "lastModified": "2019-01-02T03:04:05Z", "etag": "0cc175b9c0f1b6a831c399e269772661"}
+		]}`)
+	})
+	mux.HandleFunc("/key1", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "a") })
+	mux.HandleFunc("/key2", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "b") })
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	u, err := parseSourceURL(server.URL + "/index.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &bucketApi{buckets: map[string]map[string]*testObject{}}
+	s := &syncer{
+		src:      u,
+		prefix:   sourcePrefix(u),
+		source:   newSource(u, nil),
+		dst:      "s3://dst/mirror",
+		checksum: checksumETag,
+		limiter:  newRateLimiter(nil, 0, 0),
+		dstS3Api: api,
+	}
+
+	// The upload of key2 is stopped by its checksum mismatch, which
+	// cannot be retried as the object is streamed.
+	if _, err := s.sync(context.Background()); err == nil {
+		t.Error("checksum mismatch: got no error")
+	}
+	if o := api.buckets["dst"]["mirror/key1"]; o == nil || o.content != "a" {
+		t.Errorf("mirror/key1: got %+v, want %q", o, "a")
+	}
+	if o := api.buckets["dst"]["mirror/key2"]; o != nil {
+		t.Errorf("mirror/key2: got %+v, want none", o)
+	}
+}
+
+func TestCopyPartsMaxParts(t *testing.T) {
+	defer func(size, partSize int64) { maxCopyObjectSize, copyPartSize = size, partSize }(maxCopyObjectSize, copyPartSize)
+	maxCopyObjectSize, copyPartSize = 1, 1
+
+	content := strings.Repeat("a", s3manager.MaxUploadParts*2+1)
+	api := &bucketApi{buckets: map[string]map[string]*testObject{
+		"src": {"key": {content: content, lastModified: time.Now()}},
+	}}
+	d := newS3Destination("dst", "", newRateLimiter(nil, 0, 0), api)
+	if err := d.copy(context.Background(), "key", "src", &object{key: "key", size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.parts) > s3manager.MaxUploadParts {
+		t.Errorf("parts: got %d, want at most %d", len(api.parts), s3manager.MaxUploadParts)
+	}
+	if o := api.buckets["dst"]["key"]; o == nil || o.content != content {
+		t.Error("key: got different content")
+	}
+}
@@ -3,15 +3,23 @@ package main
 import (
 	"archive/tar"
 	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -26,86 +34,423 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 )
 
+type builderOptions struct {
+	tags             []string
+	baseImage        string
+	files            []string
+	entrypoint       []string
+	cmd              []string
+	reproducible     bool
+	platforms        []string
+	platformBinaries []string
+	output           string
+	registryAuths    []*registryAuthSpec
+	labels           []string
+	provenance       bool
+	root             string
+	signingKey       string
+	specialFiles     string
+	latestTags       []string
+	tagRetention     int
+	debounce         time.Duration
+	maxDelay         time.Duration
+}
+
 type builder struct {
-	auths     map[name.Tag]authenticator
-	baseImage v1.Image
-	cmd       []string
-	paths     []string
+	auths        map[string]authenticator
+	baseImages   map[string]v1.Image
+	baseImageRef name.Reference
+	baseAuth     authenticator
+	binaries     map[string]string
+	cmd          []string
+	entrypoint   []string
+	files        []tarballPath
+	labels       map[string]string
+	latestTags   []string
+	output       imageOutput
+	// paths are the destination directories on the host, added to the
+	// image at their paths in the image.
+	paths        []tarballPath
+	platforms    []v1.Platform
+	provenance   bool
+	reproducible bool
+	root         string
+	signingKey   *ecdsa.PrivateKey
+	specialFiles string
+	specs        []*syncSpec
+	tagRetention int
+	tagTemplates []*tagTemplate
+	tags         []name.Tag
+	created      time.Time
+	layers       map[string]*dataLayer
+}
+
+// dataLayer is the layer built from the destination directory of a sync
+// spec, which is reused while the content of the directory is unchanged.
+type dataLayer struct {
+	digest string
+	file   string
+	layer  v1.Layer
 }
 
-func newBuilderFromSyncSpecs(tags []string, specs []*syncSpec, awsClientFactory awsClientFactory) (*builder, error) {
+func newBuilderFromSyncSpecs(options *builderOptions, specs []*syncSpec, awsClientFactory awsClientFactory) (*builder, error) {
 	paths := make([]string, 0, len(specs))
+	imagePaths := make([]string, 0, len(specs))
 	cmd := make([]string, 0, len(specs)*2)
 	for _, s := range specs {
+		if isImageDestination(s.dst) {
+			return nil, fmt.Errorf("destination %s is an image and cannot be added to the image to build", s.dst)
+		}
+		if isS3Destination(s.dst) {
+			return nil, fmt.Errorf("destination %s is an S3 prefix and cannot be added to the image to build", s.dst)
+		}
 		paths = append(paths, s.dst)
 
-		value, err := s.toCSV()
+		// Each destination directory has its own layer, which would hide
+		// or duplicate the files of another one at the same or a parent
+		// path.
+		imagePath := specImagePath(options.root, s)
+		for _, p := range imagePaths {
+			if p == imagePath || isParentPath(p, imagePath) || isParentPath(imagePath, p) {
+				return nil, fmt.Errorf("destination %s is added to the image at %s, which overlaps %s of another sync spec", s.dst, imagePath, p)
+			}
+		}
+		imagePaths = append(imagePaths, imagePath)
+
+		// The image syncs to the destination directory in the image.
+		spec := *s
+		spec.dst = imagePath
+		spec.imagePath = ""
+		value, err := spec.toCSV()
 		if err != nil {
 			return nil, err
 		}
 		cmd = append(cmd, []string{"--sync", value}...)
 	}
-	return newBuilder(tags, paths, cmd, awsClientFactory)
+	if len(options.cmd) > 0 {
+		cmd = options.cmd
+	}
+
+	b, err := newBuilder(options, paths, cmd, awsClientFactory)
+	if err != nil {
+		return nil, err
+	}
+	b.specs = specs
+	for i, p := range imagePaths {
+		b.paths[i].dst = p
+		b.paths[i].exclude = specMarker(specs[i])
+	}
+
+	return b, nil
 }
 
-func newBuilder(tags, paths, cmd []string, awsClientFactory awsClientFactory) (*builder, error) {
-	k := keychain{awsClientFactory: awsClientFactory}
-	auths := make(map[name.Tag]authenticator)
-	for _, tag := range tags {
+func newBuilder(options *builderOptions, paths, cmd []string, awsClientFactory awsClientFactory) (*builder, error) {
+	k := newKeychain(awsClientFactory, options.registryAuths)
+	auths := make(map[string]authenticator)
+	resolve := func(repository name.Repository) error {
+		if _, ok := auths[repository.Name()]; ok {
+			return nil
+		}
+		auth, err := k.resolve(repository.Registry)
+		if err != nil {
+			return err
+		}
+		auths[repository.Name()] = auth
+		return nil
+	}
+
+	var tags []name.Tag
+	var tagTemplates []*tagTemplate
+	for _, tag := range options.tags {
+		if isTagTemplate(tag) {
+			t, err := parseTagTemplate(tag)
+			if err != nil {
+				return nil, err
+			}
+			if options.tagRetention > 0 && !t.hasBuildAction() {
+				return nil, fmt.Errorf("tags expanded from tag template '%s' cannot be pruned, as it formats neither the build time nor the digest, e.g. with {{.Time.Unix}} or {{.Digest.Hex}}", tag)
+			}
+			if err := resolve(t.repository); err != nil {
+				return nil, err
+			}
+			tagTemplates = append(tagTemplates, t)
+			continue
+		}
+
 		t, err := name.NewTag(tag, name.WeakValidation)
 		if err != nil {
 			return nil, err
 		}
+		if err := resolve(t.Context()); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+
+	for _, tag := range options.latestTags {
+		if !validTagRegexp.MatchString(tag) {
+			return nil, fmt.Errorf("invalid latest tag '%s'", tag)
+		}
+	}
 
-		auth, err := k.resolve(t.Context().Registry)
+	b := &builder{
+		auths:        auths,
+		baseImages:   make(map[string]v1.Image),
+		binaries:     make(map[string]string),
+		cmd:          cmd,
+		entrypoint:   options.entrypoint,
+		layers:       make(map[string]*dataLayer),
+		latestTags:   options.latestTags,
+		provenance:   options.provenance,
+		reproducible: options.reproducible,
+		root:         options.root,
+		specialFiles: options.specialFiles,
+		tagRetention: options.tagRetention,
+		tagTemplates: tagTemplates,
+		tags:         tags,
+	}
+
+	for _, p := range paths {
+		b.paths = append(b.paths, tarballPath{src: p, dst: imagePath(b.root, p)})
+	}
+
+	if b.specialFiles == "" {
+		b.specialFiles = specialFilesSkip
+	}
+	if err := validateSpecialFilesPolicy(b.specialFiles); err != nil {
+		return nil, err
+	}
+
+	labels, err := parseLabels(options.labels)
+	if err != nil {
+		return nil, err
+	}
+	b.labels = labels
+
+	if b.reproducible {
+		if b.created, err = sourceDateEpoch(); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.baseImage != "" {
+		ref, err := name.ParseReference(options.baseImage, name.WeakValidation)
 		if err != nil {
 			return nil, err
 		}
 
-		auths[t] = auth
+		if b.baseAuth, err = k.resolve(ref.Context().Registry); err != nil {
+			return nil, err
+		}
+		b.baseImageRef = ref
+	}
+
+	for _, f := range options.files {
+		parts := strings.SplitN(f, ":", 2)
+		if len(parts) == 1 {
+			parts = append(parts, parts[0])
+		}
+		if !filepath.IsAbs(parts[1]) {
+			return nil, fmt.Errorf("destination of image file '%s' must be an absolute path", f)
+		}
+		b.files = append(b.files, tarballPath{src: parts[0], dst: parts[1]})
+	}
+
+	output, err := parseImageOutput(options.output)
+	if err != nil {
+		return nil, err
 	}
+	b.output = output
 
-	return &builder{
-		auths: auths,
-		cmd:   cmd,
-		paths: paths,
-	}, nil
+	if options.signingKey != "" {
+		if b.signingKey, err = loadSigningKey(options.signingKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if (b.provenance || b.signingKey != nil) && b.output.kind == imageOutputDockerArchive {
+		return nil, fmt.Errorf("signatures and provenance attestations cannot be written to a docker archive")
+	}
+
+	for _, p := range options.platforms {
+		platform, err := parsePlatform(p)
+		if err != nil {
+			return nil, err
+		}
+		b.platforms = append(b.platforms, platform)
+	}
+
+	for _, p := range options.platformBinaries {
+		parts := strings.SplitN(p, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid platform binary '%s' must be a platform=path pair", p)
+		}
+		platform, err := parsePlatform(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		b.binaries[platformString(platform)] = parts[1]
+	}
+
+	return b, nil
 }
 
-func (b *builder) build(ctx context.Context) error {
-	image, err := b.getBaseImage()
+// build builds the image from snapshots of the destination directories, taken
+// by the sources in the same order as the paths, and pushes it. The results of
+// the syncs that produced the snapshots are recorded in the labels and the
+// annotations of the image. If sources is nil, the paths are read directly.
+func (b *builder) build(ctx context.Context, sources []snapshotter) error {
+	started := time.Now()
+	created := started
+	if b.reproducible {
+		created = b.created
+	}
+
+	layers := make([]v1.Layer, 0, len(b.paths))
+	results := make([]*syncResult, len(b.paths))
+	for i, p := range b.paths {
+		var source snapshotter = liveDirectory(p.src)
+		if sources != nil {
+			source = sources[i]
+		}
+
+		layer, result, err := b.snapshotLayer(source, p)
+		if err != nil {
+			return err
+		}
+		layers = append(layers, layer)
+		results[i] = result
+	}
+
+	labels := b.imageLabels(results)
+	annotations := imageAnnotations(labels, created)
+
+	var artifact digester
+	if len(b.platforms) == 0 {
+		image, err := b.image(ctx, nil, layers, labels, annotations, created)
+		if err != nil {
+			return err
+		}
+		artifact = image
+	} else {
+		images := make([]v1.Image, 0, len(b.platforms))
+		for i := range b.platforms {
+			image, err := b.image(ctx, &b.platforms[i], layers, labels, annotations, created)
+			if err != nil {
+				return err
+			}
+			images = append(images, image)
+		}
+
+		index, err := newImageIndex(images, b.platforms, annotations)
+		if err != nil {
+			return err
+		}
+		artifact = index
+	}
+
+	digest, err := artifact.Digest()
 	if err != nil {
 		return err
 	}
-
-	file, err := ioutil.TempFile("", "s3-sync")
+	tags, err := b.expandTags(newTagData(started, digest, b.specs, results))
 	if err != nil {
 		return err
 	}
-	defer os.Remove(file.Name())
 
-	if err := createTarball(b.paths, file); err != nil {
+	if err := b.push(ctx, artifact, tags); err != nil {
 		return err
 	}
 
-	layer, err := tarball.LayerFromFile(file.Name())
+	if b.signingKey != nil {
+		if err := b.pushSignature(ctx, artifact, tags); err != nil {
+			return err
+		}
+	}
+
+	if b.provenance {
+		if err := b.pushProvenance(ctx, artifact, tags, results, started); err != nil {
+			return err
+		}
+	}
+
+	if b.tagRetention > 0 && b.output.kind == imageOutputRegistry {
+		if err := b.pruneTags(ctx, tags); err != nil {
+			log.Printf("Error pruning tags: %v\n", err)
+		}
+	}
+
+	return nil
+}
+
+// image returns the image for the platform, which consists of the base image
+// and the data layers. If platform is nil, the default base image is used.
+func (b *builder) image(ctx context.Context, platform *v1.Platform, layers []v1.Layer, labels, annotations map[string]string, created time.Time) (v1.Image, error) {
+	image, err := b.getBaseImage(ctx, platform)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	image, err = mutate.AppendLayers(image, layer)
+	image, err = mutate.AppendLayers(image, layers...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	image, err = mutate.CreatedAt(image, v1.Time{time.Now()})
+	configFile, err := image.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	config := *configFile.Config.DeepCopy()
+	if config.Labels == nil {
+		config.Labels = make(map[string]string, len(labels))
+	}
+	for k, v := range labels {
+		config.Labels[k] = v
+	}
+
+	if image, err = mutate.Config(image, config); err != nil {
+		return nil, err
+	}
+
+	if image, err = mutate.CreatedAt(image, v1.Time{Time: created}); err != nil {
+		return nil, err
+	}
+
+	return annotateImage(image, annotations), nil
+}
+
+// push pushes the image or the image index to the tags, or writes it to the
+// local output.
+func (b *builder) push(ctx context.Context, artifact digester, tags []name.Tag) error {
+	switch b.output.kind {
+	case imageOutputOCI:
+		log.Printf("Writing image to OCI image layout %s...\n", b.output.path)
+		return writeLayout(b.output.path, artifact, tags)
+	case imageOutputDockerArchive:
+		log.Printf("Writing image to docker archive %s...\n", b.output.path)
+		return writeDockerArchive(b.output.path, artifact, tags)
+	}
+
+	digest, err := artifact.Digest()
 	if err != nil {
 		return err
 	}
 
-	for tag, a := range b.auths {
-		auth := authnAuthenticatorFunc(func() (string, error) { return a.authorization(ctx) })
-		if err := remote.Write(tag, image, remote.WithAuth(auth)); err != nil {
+	for _, tag := range tags {
+		options := b.remoteOptions(ctx, tag.Context())
+		if b.reproducible && imageExists(tag, digest, options) {
+			log.Printf("Skipping pushing %s as %s already exists\n", tag, digest)
+			continue
+		}
+
+		log.Printf("Pushing %s...\n", tag)
+		switch artifact := artifact.(type) {
+		case v1.ImageIndex:
+			err = remote.WriteIndex(tag, artifact, options...)
+		case v1.Image:
+			err = remote.Write(tag, artifact, options...)
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -113,95 +458,417 @@ func (b *builder) build(ctx context.Context) error {
 	return nil
 }
 
-func (b *builder) getBaseImage() (v1.Image, error) {
-	if b.baseImage != nil {
-		return b.baseImage, nil
+// remoteOptions returns the options of the registry client for the
+// repository.
+func (b *builder) remoteOptions(ctx context.Context, repository name.Repository) []remote.Option {
+	return remoteOptions(ctx, b.auths[repository.Name()])
+}
+
+// maxTarballAttempts is the number of times a layer is built before giving up
+// on a snapshot whose files keep changing.
+const maxTarballAttempts = 3
+
+type digester interface {
+	Digest() (v1.Hash, error)
+}
+
+// snapshotLayer returns the layer of a snapshot taken by the source, which is
+// added to the image at the path. If a file in the snapshot is changed while
+// the layer is built, e.g. by a process writing to the destination directory
+// in place, a new snapshot is taken and the layer is built again.
+func (b *builder) snapshotLayer(source snapshotter, path tarballPath) (v1.Layer, *syncResult, error) {
+	for attempt := 1; ; attempt++ {
+		snapshot, err := source.snapshot()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		layer, err := b.dataLayer(tarballPath{src: snapshot.path, dst: path.dst, exclude: path.exclude})
+		snapshot.remove()
+		if _, ok := err.(*fileChangedError); ok && attempt < maxTarballAttempts {
+			log.Printf("Retrying building the layer of %s: %v\n", path.src, err)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return layer, snapshot.result, nil
 	}
+}
 
-	layer, err := b.baseLayer()
+// dataLayer returns the layer of the path. The layer built by the previous
+// build is returned if the content of the path has not changed since then, so
+// that only the layers of the changed paths are uploaded to the registries.
+func (b *builder) dataLayer(path tarballPath) (v1.Layer, error) {
+	file, err := ioutil.TempFile("", "s3-sync")
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 
-	image, err := mutate.AppendLayers(empty.Image, layer)
-	if err != nil {
+	h := sha256.New()
+	if err := createTarball([]tarballPath{path}, io.MultiWriter(file, h), b.tarballOptions()); err != nil {
+		os.Remove(file.Name())
 		return nil, err
 	}
+	digest := hex.EncodeToString(h.Sum(nil))
 
-	if b.baseImage, err = mutate.Config(image, b.config()); err != nil {
+	if cached := b.layers[path.dst]; cached != nil {
+		if cached.digest == digest {
+			log.Printf("Reusing the layer of %s\n", path.dst)
+			os.Remove(file.Name())
+			return cached.layer, nil
+		}
+		os.Remove(cached.file)
+		delete(b.layers, path.dst)
+	}
+
+	layer, err := tarball.LayerFromFile(file.Name())
+	if err != nil {
+		os.Remove(file.Name())
 		return nil, err
 	}
 
-	return b.baseImage, nil
+	b.layers[path.dst] = &dataLayer{digest: digest, file: file.Name(), layer: layer}
+
+	return layer, nil
 }
 
-func (b *builder) baseLayer() (v1.Layer, error) {
-	file, err := ioutil.TempFile("", "s3-sync")
+// imageExists reports whether the tag refers to the image with the digest.
+func imageExists(tag name.Tag, digest v1.Hash, options []remote.Option) bool {
+	desc, err := remote.Get(tag, options...)
+	if err != nil {
+		return false
+	}
+	return desc.Digest == digest
+}
+
+// sourceDateEpoch returns the time set by the SOURCE_DATE_EPOCH environment
+// variable, or the Unix epoch if it is not set.
+func sourceDateEpoch() (time.Time, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Unix(0, 0).UTC(), nil
+	}
+
+	sec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH: %v", err)
+	}
+
+	return time.Unix(sec, 0).UTC(), nil
+}
+
+func (b *builder) tarballOptions() tarballOptions {
+	return tarballOptions{reproducible: b.reproducible, modTime: b.created, specialFiles: b.specialFiles}
+}
+
+func (b *builder) getBaseImage(ctx context.Context, platform *v1.Platform) (v1.Image, error) {
+	key := ""
+	if platform != nil {
+		key = platformString(*platform)
+	}
+	if image := b.baseImages[key]; image != nil {
+		return image, nil
+	}
+
+	var image v1.Image
+	if b.baseImageRef != nil {
+		var err error
+		options := remoteOptions(ctx, b.baseAuth)
+		if platform != nil {
+			options = append(options, remote.WithPlatform(*platform))
+		}
+		if image, err = remote.Image(b.baseImageRef, options...); err != nil {
+			return nil, err
+		}
+		if platform != nil {
+			if err := checkImagePlatform(image, *platform); err != nil {
+				return nil, fmt.Errorf("base image %s: %v", b.baseImageRef, err)
+			}
+		}
+
+		// The default entrypoint runs the s3-sync binary, which the base
+		// image does not have.
+		if len(b.entrypoint) == 0 {
+			binary, err := b.binary(platform)
+			if err != nil {
+				return nil, err
+			}
+
+			layer, err := layerFromPaths([]tarballPath{{src: binary, dst: "/s3-sync"}}, b.tarballOptions())
+			if err != nil {
+				return nil, err
+			}
+
+			if image, err = mutate.AppendLayers(image, layer); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		binary, err := b.binary(platform)
+		if err != nil {
+			return nil, err
+		}
+
+		layer, err := b.baseLayer(binary)
+		if err != nil {
+			return nil, err
+		}
+
+		if image, err = mutate.AppendLayers(empty.Image, layer); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(b.files) > 0 {
+		layer, err := layerFromPaths(b.files, b.tarballOptions())
+		if err != nil {
+			return nil, err
+		}
+
+		if image, err = mutate.AppendLayers(image, layer); err != nil {
+			return nil, err
+		}
+	}
+
+	configFile, err := image.ConfigFile()
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	configFile = configFile.DeepCopy()
+	configFile.Config = b.config(configFile.Config)
+	if b.baseImageRef == nil && platform != nil {
+		configFile.OS = platform.OS
+		configFile.Architecture = platform.Architecture
+	}
 
-	if err := createTarball([]string{"/etc/ssl/certs/ca-certificates.crt", "/s3-sync"}, file); err != nil {
+	if image, err = mutate.ConfigFile(image, configFile); err != nil {
 		return nil, err
 	}
+	b.baseImages[key] = image
 
-	return tarball.LayerFromFile(file.Name())
+	return image, nil
 }
 
-func (b *builder) config() v1.Config {
-	config := v1.Config{}
+// checkImagePlatform returns an error if the image is not for the platform,
+// since remote.Image returns the image as it is for any platform if it is not
+// in an image index.
+func checkImagePlatform(image v1.Image, platform v1.Platform) error {
+	data, err := image.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	// The variant is not in v1.ConfigFile.
+	var config struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+		Variant      string `json:"variant"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
 
-	config.Volumes = make(map[string]struct{}, len(b.paths))
+	actual := v1.Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+	if actual.OS != platform.OS || actual.Architecture != platform.Architecture || platform.Variant != "" && actual.Variant != platform.Variant {
+		return fmt.Errorf("got an image for platform %s, want %s", platformString(actual), platformString(platform))
+	}
+	return nil
+}
+
+// binary returns the path to the s3-sync binary for the platform, which is
+// added to the image built from scratch.
+func (b *builder) binary(platform *v1.Platform) (string, error) {
+	if platform == nil {
+		return "/s3-sync", nil
+	}
+	if binary, ok := b.binaries[platformString(*platform)]; ok {
+		return binary, nil
+	}
+	if platform.OS == runtime.GOOS && platform.Architecture == runtime.GOARCH {
+		return "/s3-sync", nil
+	}
+	return "", fmt.Errorf("no s3-sync binary for platform %s", platformString(*platform))
+}
+
+func (b *builder) baseLayer(binary string) (v1.Layer, error) {
+	return layerFromPaths([]tarballPath{
+		{src: "/etc/ssl/certs/ca-certificates.crt", dst: "/etc/ssl/certs/ca-certificates.crt"},
+		{src: binary, dst: "/s3-sync"},
+	}, b.tarballOptions())
+}
+
+func (b *builder) config(config v1.Config) v1.Config {
+	volumes := make(map[string]struct{}, len(config.Volumes)+len(b.paths))
+	for p := range config.Volumes {
+		volumes[p] = struct{}{}
+	}
 	for _, p := range b.paths {
-		config.Volumes[p] = struct{}{}
+		volumes[p.dst] = struct{}{}
 	}
+	config.Volumes = volumes
 
 	config.Entrypoint = []string{"/s3-sync"}
+	if len(b.entrypoint) > 0 {
+		config.Entrypoint = b.entrypoint
+	}
 	config.Cmd = b.cmd
 
 	return config
 }
 
-func createTarball(paths []string, w io.Writer) error {
-	writer := tar.NewWriter(w)
+func layerFromPaths(paths []tarballPath, options tarballOptions) (v1.Layer, error) {
+	file, err := ioutil.TempFile("", "s3-sync")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := createTarball(paths, file, options); err != nil {
+		return nil, err
+	}
+
+	return tarball.LayerFromFile(file.Name())
+}
+
+// imagePath returns the path in the image of the destination directory on the
+// host, which is under the root directory of the image.
+func imagePath(root, dst string) string {
+	return filepath.Join(string(os.PathSeparator), root, dst)
+}
+
+// specImagePath returns the path in the image of the destination directory of
+// the sync spec, which is its image path if specified.
+func specImagePath(root string, s *syncSpec) string {
+	if s.imagePath != "" {
+		return filepath.Clean(s.imagePath)
+	}
+	return imagePath(root, s.dst)
+}
+
+// specMarker returns the path of the marker of the sync spec relative to its
+// destination directory, or an empty string if it is not in it.
+func specMarker(s *syncSpec) string {
+	if s.marker == "" {
+		return ""
+	}
+	if !filepath.IsAbs(s.marker) {
+		return filepath.Clean(s.marker)
+	}
+	rel, err := filepath.Rel(s.dst, s.marker)
+	if err != nil || !isLocalKey(rel) {
+		return ""
+	}
+	return rel
+}
+
+// isParentPath reports whether the directory at parent contains the path.
+func isParentPath(parent, path string) bool {
+	return strings.HasPrefix(path, strings.TrimSuffix(parent, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// tarballPath is a file or a directory to add to a tarball. The tree at src
+// on the host is added to the tarball at dst.
+type tarballPath struct {
+	src string
+	dst string
+	// exclude is the path relative to src of a file not to add, which is the
+	// marker of the sync spec.
+	exclude string
+}
+
+const (
+	specialFilesSkip  = "skip"
+	specialFilesError = "error"
+)
+
+// tarballOptions controls the metadata of the files written to a tarball.
+type tarballOptions struct {
+	// reproducible makes the tarball depend only on the names, modes and
+	// contents of the files, by normalising their timestamps and owners.
+	reproducible bool
+	// modTime is the modification time of all the files in a reproducible
+	// tarball.
+	modTime time.Time
+	// specialFiles is what to do with sockets, devices and named pipes,
+	// which are either skipped or an error.
+	specialFiles string
+}
+
+func validateSpecialFilesPolicy(policy string) error {
+	switch policy {
+	case specialFilesSkip, specialFilesError:
+		return nil
+	default:
+		return fmt.Errorf("unknown special files policy '%s'", policy)
+	}
+}
+
+// tarballWriter writes files to a tarball, remembering the files with
+// multiple hard links so that each of them is written only once.
+type tarballWriter struct {
+	*tar.Writer
+	w       io.Writer
+	options tarballOptions
+	links   map[fileID]string
+}
+
+// fileID identifies a file by its device and inode numbers.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+func newTarballWriter(w io.Writer, options tarballOptions) *tarballWriter {
+	return &tarballWriter{Writer: tar.NewWriter(w), w: w, options: options, links: make(map[fileID]string)}
+}
+
+func createTarball(paths []tarballPath, w io.Writer, options tarballOptions) error {
+	writer := newTarballWriter(w, options)
 	defer writer.Close()
 
 	added := make(map[string]bool)
 
 	for _, path := range paths {
-		path = strings.TrimPrefix(filepath.Clean(path), string(os.PathSeparator))
+		src := filepath.Clean(path.src)
+		dst := strings.TrimPrefix(filepath.Clean(path.dst), string(os.PathSeparator))
 
-		elements := strings.Split(path, string(os.PathSeparator))
-		for i := range elements {
+		elements := strings.Split(dst, string(os.PathSeparator))
+		for i := range elements[:len(elements)-1] {
 			p := filepath.Join(elements[:i+1]...)
 			if added[p] {
 				continue
 			}
 
-			info, err := os.Lstat(p)
-			if err != nil {
-				return err
-			}
-
-			if err := addToTarball(writer, p, info); err != nil {
+			if err := addDirToTarball(writer, p); err != nil {
 				return err
 			}
 			added[p] = true
 		}
 
-		err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
-			if added[p] {
+
+			if info.IsDir() && p != src && isSnapshotDir(p) {
+				return filepath.SkipDir
+			}
+			// The marker and the sidecar files change without the synced
+			// content changing, and would change the digest of the layer.
+			if p != src && (isXattrSidecar(p) || path.exclude != "" && p == filepath.Join(src, path.exclude)) {
+				return nil
+			}
+			name := dst + strings.TrimPrefix(p, src)
+			if added[name] {
 				return nil
 			}
 
-			if err := addToTarball(writer, p, info); err != nil {
+			if err := addToTarball(writer, p, name, info); err != nil {
 				return err
 			}
-			added[p] = true
+			added[name] = true
 
 			return nil
 		})
@@ -213,10 +880,31 @@ func createTarball(paths []string, w io.Writer) error {
 	return nil
 }
 
-func addToTarball(writer *tar.Writer, path string, info os.FileInfo) error {
+func addDirToTarball(writer *tarballWriter, name string) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + string(os.PathSeparator),
+		Mode:     0755,
+	}
+	if writer.options.reproducible {
+		header.ModTime = writer.options.modTime
+	}
+	return writer.WriteHeader(header)
+}
+
+func addToTarball(writer *tarballWriter, path, name string, info os.FileInfo) error {
+	mode := info.Mode()
+	if mode&(os.ModeSocket|os.ModeDevice|os.ModeNamedPipe) != 0 {
+		if writer.options.specialFiles == specialFilesError {
+			return fmt.Errorf("%s is a special file of mode %s", path, mode)
+		}
+		log.Printf("Skipping special file %s of mode %s\n", path, mode)
+		return nil
+	}
+
 	var link string
 	var err error
-	if info.Mode()&os.ModeSymlink != 0 {
+	if mode&os.ModeSymlink != 0 {
 		if link, err = os.Readlink(path); err != nil {
 			return err
 		}
@@ -226,18 +914,35 @@ func addToTarball(writer *tar.Writer, path string, info os.FileInfo) error {
 	if err != nil {
 		return err
 	}
-	header.Name = path
+	header.Name = name
 	if info.IsDir() {
 		header.Name += string(os.PathSeparator)
 		header.ModTime = time.Time{}
 	}
+	if writer.options.reproducible {
+		header.ModTime = writer.options.modTime
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+		header.Uid = 0
+		header.Gid = 0
+		header.Uname = ""
+		header.Gname = ""
+	}
 
-	if err := writer.WriteHeader(header); err != nil {
-		return err
+	if !mode.IsRegular() {
+		return writer.WriteHeader(header)
 	}
 
-	if !info.Mode().IsRegular() {
-		return nil
+	// Write the files with multiple hard links as links to the first one.
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+		id := fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+		if first, ok := writer.links[id]; ok {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = first
+			header.Size = 0
+			return writer.WriteHeader(header)
+		}
+		writer.links[id] = name
 	}
 
 	file, err := os.Open(path)
@@ -246,18 +951,72 @@ func addToTarball(writer *tar.Writer, path string, info os.FileInfo) error {
 	}
 	defer file.Close()
 
-	if _, err := io.Copy(writer, file); err != nil {
+	regions, err := sparseRegions(file, info)
+	if err != nil {
+		return err
+	}
+	if regions != nil {
+		err = writer.writeSparseFile(header, file, regions)
+	} else {
+		err = writer.writeFile(header, file)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Detect the file modified while it was being read, whose content in the
+	// tarball may be a mix of the old and the new one.
+	after, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if after.Size() != info.Size() || !after.ModTime().Equal(info.ModTime()) {
+		return &fileChangedError{path: path}
+	}
+
+	return nil
+}
+
+func (w *tarballWriter) writeFile(header *tar.Header, file *os.File) error {
+	if err := w.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(w, file, header.Size); err == io.EOF {
+		return &fileChangedError{path: file.Name()}
+	} else if err != nil {
 		return err
 	}
 
 	return nil
 }
 
+type fileChangedError struct {
+	path string
+}
+
+func (e *fileChangedError) Error() string {
+	return fmt.Sprintf("%s was changed while it was being added to the tarball", e.path)
+}
+
 type keychain struct {
 	awsClientFactory awsClientFactory
+	registryAuths    map[string]*registryAuthSpec
+}
+
+func newKeychain(awsClientFactory awsClientFactory, registryAuths []*registryAuthSpec) *keychain {
+	k := &keychain{awsClientFactory: awsClientFactory, registryAuths: make(map[string]*registryAuthSpec)}
+	for _, spec := range registryAuths {
+		k.registryAuths[spec.registry] = spec
+	}
+	return k
 }
 
 func (k *keychain) resolve(registry name.Registry) (authenticator, error) {
+	if spec, ok := k.registryAuths[registry.Name()]; ok {
+		return newRegistryAuthenticator(spec)
+	}
+
 	auth, err := authn.DefaultKeychain.Resolve(registry)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestCreateTarballReproducible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builder_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "key1")
+	if err := ioutil.WriteFile(path, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	options := tarballOptions{reproducible: true, modTime: time.Unix(0, 0)}
+	paths := []tarballPath{{src: dir, dst: "/data"}}
+
+	var tarballs [2]bytes.Buffer
+	for i := range tarballs {
+		modTime := time.Now().Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dir, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := createTarball(paths, &tarballs[i], options); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !bytes.Equal(tarballs[0].Bytes(), tarballs[1].Bytes()) {
+		t.Error("createTarball: got different tarballs for the same content")
+	}
+}
+
+func TestBuilderDataLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builder_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths := []string{filepath.Join(dir, "dst1"), filepath.Join(dir, "dst2")}
+	for _, p := range paths {
+		if err := os.Mkdir(p, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(p, "key1"), []byte("a"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := &builder{layers: make(map[string]*dataLayer)}
+	defer func() {
+		for _, l := range b.layers {
+			os.Remove(l.file)
+		}
+	}()
+
+	layers := make(map[string]interface{})
+	for _, p := range paths {
+		layer, err := b.dataLayer(tarballPath{src: p, dst: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers[p] = layer
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(paths[1], "key2"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, p := range paths {
+		layer, err := b.dataLayer(tarballPath{src: p, dst: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reused := layer == layers[p]; reused != (i == 0) {
+			t.Errorf("path=%s, reused: got %t, want %t", p, reused, i == 0)
+		}
+	}
+}
+
+func TestBuilderBuildOCILayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builder_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "dst")
+	if err := os.Mkdir(dst, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dst, "key1"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	layout := filepath.Join(dir, "layout")
+	options := &builderOptions{tags: []string{"registry.example.com/repository:tag"}, output: "oci:" + layout}
+	b, err := newBuilder(options, []string{dst}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, l := range b.layers {
+			os.Remove(l.file)
+		}
+	}()
+	b.baseImages[""] = empty.Image
+
+	if err := b.build(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index v1.IndexManifest
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 {
+		t.Fatalf("manifests: got %d, want 1", len(index.Manifests))
+	}
+	desc := index.Manifests[0]
+	if name := desc.Annotations[imageRefNameAnnotation]; name != "tag" {
+		t.Errorf("ref name: got %q, want %q", name, "tag")
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(layout, "blobs", desc.Digest.Algorithm, desc.Digest.Hex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("layers: got %d, want 1", len(manifest.Layers))
+	}
+	for _, d := range append(manifest.Layers, manifest.Config) {
+		if _, err := os.Stat(filepath.Join(layout, "blobs", d.Digest.Algorithm, d.Digest.Hex)); err != nil {
+			t.Errorf("blob %s: %v", d.Digest, err)
+		}
+	}
+}
+
+func TestBuilderBuildMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builder_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "dst")
+	if err := os.Mkdir(dst, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	layout := filepath.Join(dir, "layout")
+	options := &builderOptions{
+		tags:       []string{"registry.example.com/repository:tag"},
+		output:     "oci:" + layout,
+		labels:     []string{"team=data"},
+		provenance: true,
+	}
+	b, err := newBuilder(options, []string{dst}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, l := range b.layers {
+			os.Remove(l.file)
+		}
+	}()
+	b.specs = []*syncSpec{{bucket: "bucket", prefix: "current", dst: dst}}
+	b.baseImages[""] = empty.Image
+
+	result := &syncResult{resolvedBucket: "bucket", resolvedPrefix: "releases/1/", objects: 2, bytes: 3, digest: "sha256:abc"}
+	if err := b.build(context.Background(), []snapshotter{&staticSnapshot{path: dst, result: result}}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index v1.IndexManifest
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 2 {
+		t.Fatalf("manifests: got %d, want 2", len(index.Manifests))
+	}
+
+	var manifest v1.Manifest
+	readBlob(t, layout, index.Manifests[0].Digest, &manifest)
+	var config v1.ConfigFile
+	readBlob(t, layout, manifest.Config.Digest, &config)
+
+	expected := map[string]string{
+		labelPrefix + "version":                "dev",
+		labelPrefix + "sync.0.bucket":          "bucket",
+		labelPrefix + "sync.0.prefix":          "current",
+		labelPrefix + "sync.0.resolved-prefix": "releases/1/",
+		labelPrefix + "sync.0.objects":         "2",
+		labelPrefix + "sync.0.digest":          "sha256:abc",
+		"team":                                 "data",
+	}
+	for k, v := range expected {
+		if got := config.Config.Labels[k]; got != v {
+			t.Errorf("label %s: got %q, want %q", k, got, v)
+		}
+		if got := manifest.Annotations[k]; got != v {
+			t.Errorf("annotation %s: got %q, want %q", k, got, v)
+		}
+	}
+	if _, ok := manifest.Annotations[imageCreatedAnnotation]; !ok {
+		t.Errorf("annotation %s is missing", imageCreatedAnnotation)
+	}
+
+	att := index.Manifests[1]
+	want := fmt.Sprintf("%s-%s.att", index.Manifests[0].Digest.Algorithm, index.Manifests[0].Digest.Hex)
+	if name := att.Annotations[imageRefNameAnnotation]; name != want {
+		t.Errorf("attestation ref name: got %q, want %q", name, want)
+	}
+
+	var attManifest v1.Manifest
+	readBlob(t, layout, att.Digest, &attManifest)
+	var envelope dsseEnvelope
+	readBlob(t, layout, attManifest.Layers[0].Digest, &envelope)
+	var statement inTotoStatement
+	if err := json.Unmarshal(envelope.Payload, &statement); err != nil {
+		t.Fatal(err)
+	}
+	if got := statement.Subject[0].Digest["sha256"]; got != index.Manifests[0].Digest.Hex {
+		t.Errorf("subject digest: got %s, want %s", got, index.Manifests[0].Digest.Hex)
+	}
+	if len(statement.Predicate.Materials) != 1 || statement.Predicate.Materials[0].URI != "s3://bucket/releases/1/" {
+		t.Errorf("materials: got %+v", statement.Predicate.Materials)
+	}
+}
+
+func TestBuilderBuildUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builder_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	api := &bucketApi{buckets: map[string]map[string]*testObject{
+		"bucket": {"prefix/key1": {content: "a", lastModified: time.Now().Add(-time.Hour)}},
+	}}
+	spec := &syncSpec{bucket: "bucket", prefix: "prefix", dst: filepath.Join(dir, "dst"), marker: ".s3-sync.json"}
+	s := &syncer{
+		spec:    spec,
+		bucket:  spec.bucket,
+		prefix:  spec.prefix,
+		dst:     spec.dst,
+		marker:  spec.marker,
+		limiter: newRateLimiter(nil, 0, 0),
+		s3Api:   api,
+		links:   newLinkCache(),
+	}
+
+	layout := filepath.Join(dir, "layout")
+	options := &builderOptions{tags: []string{"registry.example.com/repository:tag"}, output: "oci:" + layout, reproducible: true}
+	b, err := newBuilderFromSyncSpecs(options, []*syncSpec{spec}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, l := range b.layers {
+			os.Remove(l.file)
+		}
+	}()
+	b.baseImages[""] = empty.Image
+
+	var digests []v1.Hash
+	for i := 0; i < 2; i++ {
+		if _, err := s.sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.build(context.Background(), []snapshotter{s}); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(layout, "index.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var index v1.IndexManifest
+		if err := json.Unmarshal(data, &index); err != nil {
+			t.Fatal(err)
+		}
+		digests = append(digests, index.Manifests[0].Digest)
+
+		// The sidecar files do not change the layer either.
+		if err := writeXattrSidecar(filepath.Join(spec.dst, "key1"), etagXattr, `"etag"`); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if digests[0] != digests[1] {
+		t.Errorf("digests: got %s and %s, want the same", digests[0], digests[1])
+	}
+}
+
+func readBlob(t *testing.T, layout string, digest v1.Hash, v interface{}) {
+	data, err := ioutil.ReadFile(filepath.Join(layout, "blobs", digest.Algorithm, digest.Hex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// staticSnapshot is a snapshotter of a directory used as is, with the result
+// of a sync.
+type staticSnapshot snapshot
+
+func (s *staticSnapshot) snapshot() (*snapshot, error) {
+	return (*snapshot)(s), nil
+}
+
+func TestAddToTarballFileChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builder_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "key1")
+	if err := ioutil.WriteFile(path, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Modify the file in place after it has been listed.
+	if err := ioutil.WriteFile(path, []byte("bc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	writer := newTarballWriter(ioutil.Discard, tarballOptions{})
+	err = addToTarball(writer, path, "key1", info)
+	if _, ok := err.(*fileChangedError); !ok {
+		t.Errorf("error: got %v, want a fileChangedError", err)
+	}
+}
+
+func TestCreateTarballLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builder_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "key1"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "key1"), filepath.Join(dir, "key2")); err != nil {
+		t.Fatal(err)
+	}
+
+	sparse, err := os.Create(filepath.Join(dir, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sparse.WriteAt([]byte("b"), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := sparse.Truncate(2 << 20); err != nil {
+		t.Fatal(err)
+	}
+	sparse.Close()
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	paths := []tarballPath{{src: dir, dst: imagePath("/root", "/data")}}
+	if err := createTarball(paths, ioutil.Discard, tarballOptions{specialFiles: specialFilesError}); err == nil {
+		t.Error("special file: got no error")
+	}
+
+	var tarball bytes.Buffer
+	if err := createTarball(paths, &tarball, tarballOptions{specialFiles: specialFilesSkip}); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := make(map[string]*tar.Header)
+	contents := make(map[string][]byte)
+	reader := tar.NewReader(&tarball)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers[header.Name] = header
+		contents[header.Name] = content
+	}
+
+	if _, ok := headers["root/data/socket"]; ok {
+		t.Error("socket: got an entry, want it skipped")
+	}
+	first, second := "root/data/key1", "root/data/key2"
+	if header := headers[second]; header == nil || header.Typeflag != tar.TypeLink || header.Linkname != first {
+		t.Errorf("%s: got %+v, want a link to %s", second, header, first)
+	}
+	if string(contents[first]) != "a" {
+		t.Errorf("%s: got %q, want %q", first, contents[first], "a")
+	}
+
+	want := make([]byte, 2<<20)
+	want[1<<20] = 'b'
+	if header := headers["root/data/sparse"]; header == nil || header.Size != int64(len(want)) {
+		t.Fatalf("sparse: got %+v, want a file of %d bytes", header, len(want))
+	}
+	if !bytes.Equal(contents["root/data/sparse"], want) {
+		t.Error("sparse: got different content")
+	}
+}
+
+func TestNewBuilderFromSyncSpecsImagePath(t *testing.T) {
+	specs := []*syncSpec{
+		{bucket: "bucket", prefix: "foo", dst: "/var/cache/s3/foo", imagePath: "/data/foo"},
+		{bucket: "bucket", prefix: "bar", dst: "/var/cache/s3/bar"},
+	}
+	b, err := newBuilderFromSyncSpecs(&builderOptions{root: "/srv"}, specs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []tarballPath{
+		{src: "/var/cache/s3/foo", dst: "/data/foo"},
+		{src: "/var/cache/s3/bar", dst: "/srv/var/cache/s3/bar"},
+	}
+	if !reflect.DeepEqual(b.paths, want) {
+		t.Errorf("paths: got %v, want %v", b.paths, want)
+	}
+
+	config := b.config(v1.Config{})
+	for _, p := range want {
+		if _, ok := config.Volumes[p.dst]; !ok {
+			t.Errorf("volumes: got %v, want %s", config.Volumes, p.dst)
+		}
+	}
+
+	for i, p := range want {
+		var spec syncSpec
+		if err := spec.fromCSV(config.Cmd[i*2+1]); err != nil {
+			t.Fatal(err)
+		}
+		if spec.dst != p.dst || spec.imagePath != "" {
+			t.Errorf("cmd: got dst=%s image-path=%s, want dst=%s", spec.dst, spec.imagePath, p.dst)
+		}
+	}
+
+	for _, specs := range [][]*syncSpec{
+		{{dst: "/var/cache/s3/foo", imagePath: "/data"}, {dst: "/var/cache/s3/bar", imagePath: "/data/"}},
+		{{dst: "/var/cache/s3/foo", imagePath: "/data"}, {dst: "/var/cache/s3/bar", imagePath: "/data/bar"}},
+		{{dst: "/var/cache/s3/foo/bar"}, {dst: "/var/cache/s3/foo"}},
+		{{dst: "/var/cache/s3/foo"}, {dst: "/var/cache/s3/bar", imagePath: "/"}},
+	} {
+		if _, err := newBuilderFromSyncSpecs(&builderOptions{root: "/"}, specs, nil); err == nil {
+			t.Errorf("image paths %s and %s: got no error", specImagePath("/", specs[0]), specImagePath("/", specs[1]))
+		}
+	}
+}
+
+func TestBuilderBaseImage(t *testing.T) {
+	registry := newTestRegistry()
+	defer registry.Close()
+
+	ref, err := name.NewTag(registry.host()+"/repo:base", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := random.Image(16, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile, err := base.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile = configFile.DeepCopy()
+	configFile.OS, configFile.Architecture = "linux", "amd64"
+	if base, err = mutate.ConfigFile(base, configFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, base); err != nil {
+		t.Fatal(err)
+	}
+
+	binary, err := ioutil.TempFile("", "builder_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.Close()
+	defer os.Remove(binary.Name())
+
+	tests := []struct {
+		entrypoint []string
+		platform   v1.Platform
+		layers     int
+	}{
+		{platform: v1.Platform{OS: "linux", Architecture: "amd64"}, layers: 2},
+		{entrypoint: []string{"/bin/sh"}, platform: v1.Platform{OS: "linux", Architecture: "amd64"}, layers: 1},
+		{platform: v1.Platform{OS: "linux", Architecture: "arm64"}},
+		{platform: v1.Platform{OS: "linux", Architecture: "amd64", Variant: "v2"}},
+	}
+	for i, test := range tests {
+		options := &builderOptions{
+			baseImage:        ref.String(),
+			entrypoint:       test.entrypoint,
+			platformBinaries: []string{"linux/amd64=" + binary.Name(), "linux/arm64=" + binary.Name()},
+		}
+		b, err := newBuilder(options, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		image, err := b.getBaseImage(context.Background(), &test.platform)
+		if test.layers == 0 {
+			if err == nil {
+				t.Errorf("test %d: got no error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: %v", i, err)
+			continue
+		}
+		layers, err := image.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(layers) != test.layers {
+			t.Errorf("test %d, layers: got %d, want %d", i, len(layers), test.layers)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	checksumNone   = "none"
+	checksumAuto   = "auto"
+	checksumETag   = "etag"
+	checksumSHA256 = "sha256"
+	checksumCRC32C = "crc32c"
+)
+
+// maxChecksumAttempts is the number of times an object is downloaded before
+// giving up when the downloaded content does not match its checksum.
+const maxChecksumAttempts = 3
+
+var (
+	singlePartETagRegexp    = regexp.MustCompile(`\A[0-9a-f]{32}\z`)
+	compositeChecksumRegexp = regexp.MustCompile(`-[0-9]+\z`)
+)
+
+func validateChecksumAlgorithm(algorithm string) error {
+	switch algorithm {
+	case checksumNone, checksumAuto, checksumETag, checksumSHA256, checksumCRC32C:
+		return nil
+	default:
+		return fmt.Errorf("unknown checksum algorithm '%s'", algorithm)
+	}
+}
+
+type checksum struct {
+	algorithm string
+	expected  string
+}
+
+func (c *checksum) newHash() hash.Hash {
+	switch c.algorithm {
+	case checksumSHA256:
+		return sha256.New()
+	case checksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	default:
+		return md5.New()
+	}
+}
+
+func (c *checksum) encode(sum []byte) string {
+	if c.algorithm == checksumETag {
+		return hex.EncodeToString(sum)
+	}
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+func (c *checksum) verify(r io.Reader) error {
+	h := c.newHash()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	return c.check(h)
+}
+
+func (c *checksum) check(h hash.Hash) error {
+	if actual := c.encode(h.Sum(nil)); actual != c.expected {
+		return &checksumMismatchError{algorithm: c.algorithm, actual: actual, expected: c.expected}
+	}
+	return nil
+}
+
+type checksumMismatchError struct {
+	algorithm string
+	actual    string
+	expected  string
+}
+
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch: got %s, want %s", e.algorithm, e.actual, e.expected)
+}
+
+// expectedChecksum returns the checksum the downloaded content of the object
+// must match, or nil if there is nothing to verify it against. The checksums
+// stored with the object are read from the response headers of the GET request
+// downloading it, or of a HEAD request if there are none, as for the objects
+// downloaded in parts.
+func (s *syncer) expectedChecksum(ctx context.Context, object *object, header http.Header) (*checksum, error) {
+	switch s.checksum {
+	case "", checksumNone:
+		return nil, nil
+	case checksumETag:
+		return etagChecksum(object)
+	}
+
+	if header == nil {
+		var err error
+		if header, err = s.headObjectChecksums(ctx, object.key); err != nil {
+			return nil, err
+		}
+	}
+	return s.headerChecksum(object, header)
+}
+
+// headerChecksum returns the checksum of the object in the response headers of
+// a GET or HEAD request for it. The checksums of multipart uploads, which are
+// checksums of the checksums of the parts followed by "-" and the number of
+// parts, cannot be compared with the downloaded content and are skipped.
+func (s *syncer) headerChecksum(object *object, header http.Header) (*checksum, error) {
+	switch s.checksum {
+	case checksumSHA256, checksumCRC32C:
+		value := header.Get("x-amz-checksum-" + s.checksum)
+		if value == "" {
+			return nil, fmt.Errorf("%s has no %s checksum", s.location(object.key), s.checksum)
+		}
+		if compositeChecksumRegexp.MatchString(value) {
+			log.Printf("Skipping verification of %s with its %s checksum of the parts: %s\n", s.location(object.key), s.checksum, value)
+			return nil, nil
+		}
+		return &checksum{algorithm: s.checksum, expected: value}, nil
+	}
+
+	for _, algorithm := range []string{checksumSHA256, checksumCRC32C} {
+		if value := header.Get("x-amz-checksum-" + algorithm); value != "" && !compositeChecksumRegexp.MatchString(value) {
+			return &checksum{algorithm: algorithm, expected: value}, nil
+		}
+	}
+	if c, err := etagChecksum(object); err == nil {
+		return c, nil
+	}
+	return nil, nil
+}
+
+func etagChecksum(object *object) (*checksum, error) {
+	etag := strings.Trim(object.etag, `"`)
+	if !singlePartETagRegexp.MatchString(etag) {
+		return nil, fmt.Errorf("ETag of %s is not an MD5 digest: %s", object.key, object.etag)
+	}
+	return &checksum{algorithm: checksumETag, expected: etag}, nil
+}
+
+// headObjectChecksums returns the response headers of a HEAD request for the
+// object, including the additional checksums stored with it.
+func (s *syncer) headObjectChecksums(ctx context.Context, key string) (http.Header, error) {
+	var header http.Header
+	input := s3.HeadObjectInput{Bucket: aws.String(s.objectBucket()), Key: aws.String(key)}
+	opts := append(s.limiter.requestOptions(), checksumModeOption(&header))
+	_, err := s.s3Api.HeadObjectWithContext(ctx, &input, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	return header, nil
+}
+
+// checksumModeOption returns the option of a GET or HEAD request for an object
+// that requests the additional checksums stored with it and records the
+// response headers holding them.
+func checksumModeOption(header *http.Header) request.Option {
+	return func(r *request.Request) {
+		r.HTTPRequest.Header.Set("x-amz-checksum-mode", "ENABLED")
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			if r.HTTPResponse != nil {
+				*header = r.HTTPResponse.Header
+			}
+		})
+	}
+}
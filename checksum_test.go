@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHeaderChecksum(t *testing.T) {
+	singlePart := &object{key: "key", etag: `"900150983cd24fb0d6963f7d28e17f72"`}
+	multipart := &object{key: "key", etag: `"900150983cd24fb0d6963f7d28e17f72-3"`}
+
+	tests := []struct {
+		algorithm string
+		object    *object
+		header    http.Header
+		want      *checksum
+	}{
+		{
+			algorithm: checksumSHA256,
+			object:    singlePart,
+			header:    http.Header{"X-Amz-Checksum-Sha256": {"ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0="}},
+			want:      &checksum{algorithm: checksumSHA256, expected: "ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0="},
+		},
+		{
+			algorithm: checksumSHA256,
+			object:    multipart,
+			header:    http.Header{"X-Amz-Checksum-Sha256": {"ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0=-3"}},
+		},
+		{
+			algorithm: checksumAuto,
+			object:    singlePart,
+			header:    http.Header{"X-Amz-Checksum-Crc32c": {"tnMSbg==-3"}},
+			want:      &checksum{algorithm: checksumETag, expected: "900150983cd24fb0d6963f7d28e17f72"},
+		},
+		{
+			algorithm: checksumAuto,
+			object:    multipart,
+			header:    http.Header{"X-Amz-Checksum-Crc32c": {"tnMSbg==-3"}},
+		},
+	}
+	for i, test := range tests {
+		s := &syncer{bucket: "bucket", checksum: test.algorithm}
+		c, err := s.headerChecksum(test.object, test.header)
+		if err != nil {
+			t.Errorf("test %d: %v", i, err)
+			continue
+		}
+		if (c == nil) != (test.want == nil) || c != nil && *c != *test.want {
+			t.Errorf("test %d: got %+v, want %+v", i, c, test.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	decompressGzip = "gzip"
+	decompressZstd = "zstd"
+	decompressAuto = "auto"
+)
+
+// compressionExtensions are the extensions of the objects compressed in each
+// format, which are decompressed in auto mode.
+var compressionExtensions = map[string]string{
+	decompressGzip: ".gz",
+	decompressZstd: ".zst",
+}
+
+// etagXattr is the extended attribute that records the ETag of the object a
+// decompressed file was created from, since its size no longer matches the
+// size of the object.
+const etagXattr = "user.s3-sync.etag"
+
+// xattrSidecarPrefix is the prefix of the names of the sidecar files that
+// record the extended attributes on the file systems without them.
+const xattrSidecarPrefix = ".s3-sync-xattr."
+
+func validateDecompressMode(mode string) error {
+	switch mode {
+	case decompressGzip, decompressZstd, decompressAuto:
+		return nil
+	default:
+		return fmt.Errorf("unknown decompression mode '%s'", mode)
+	}
+}
+
+// compressionByKey returns the format the object with the key is decompressed
+// from regardless of its Content-Encoding, or an empty string if none.
+func compressionByKey(mode, key string) string {
+	switch mode {
+	case decompressGzip, decompressZstd:
+		return mode
+	case decompressAuto:
+		for compression, extension := range compressionExtensions {
+			if strings.HasSuffix(key, extension) {
+				return compression
+			}
+		}
+	}
+	return ""
+}
+
+// stripExtensions removes the compression extension from the compare keys of
+// the objects that are decompressed and sorts them again by the new keys.
+func stripExtensions(objects []*object) error {
+	for _, o := range objects {
+		if o.compression != "" {
+			o.compareKey = strings.TrimSuffix(o.compareKey, compressionExtensions[o.compression])
+		}
+	}
+
+	sort.SliceStable(objects, func(i, j int) bool { return objects[i].compareKey < objects[j].compareKey })
+
+	for i := 1; i < len(objects); i++ {
+		if objects[i-1].compareKey == objects[i].compareKey {
+			return fmt.Errorf("%s and %s are both synced to %s", objects[i-1].key, objects[i].key, objects[i].compareKey)
+		}
+	}
+
+	return nil
+}
+
+func (s *syncer) downloadDecompressed(ctx context.Context, object *object, file downloadFile) error {
+	content, contentEncoding, header, err := s.openObject(ctx, object.key)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	checksum, err := s.expectedChecksum(ctx, object, header)
+	if err != nil {
+		return err
+	}
+
+	body := s.limiter.reader(ctx, content)
+	var h hash.Hash
+	if checksum != nil {
+		h = checksum.newHash()
+		body = io.TeeReader(body, h)
+	}
+
+	compression := object.compression
+	if compression == "" && compressionExtensions[contentEncoding] != "" {
+		compression = contentEncoding
+	}
+	r, err := decompressReader(compression, body)
+	if err != nil {
+		return fmt.Errorf("error decompressing %s: %v", s.location(object.key), err)
+	}
+	defer r.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+
+	if checksum == nil {
+		return nil
+	}
+
+	// Read the rest of the body so that the whole object is checksummed.
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return err
+	}
+	return checksum.check(h)
+}
+
+// decompressReader returns the reader of the content decompressed from the
+// format, or the content as it is if the format is empty.
+func decompressReader(compression string, r io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case decompressGzip:
+		return gzip.NewReader(r)
+	case decompressZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(r), nil
+	}
+}
+
+// setXattr sets the extended attribute of the file. The error satisfies
+// xattrUnsupported if the file system does not support extended attributes,
+// in which case it can be recorded by writeXattrSidecar instead.
+func setXattr(path, attr, value string) error {
+	return unix.Lsetxattr(path, attr, []byte(value), 0)
+}
+
+// getXattr returns the extended attribute of the file, or the one recorded in
+// its sidecar file if the file system does not support extended attributes.
+func getXattr(path, attr string) (string, error) {
+	buf := make([]byte, 256)
+	n, err := unix.Lgetxattr(path, attr, buf)
+	if err == unix.ENODATA {
+		return "", nil
+	}
+	if xattrUnsupported(err) {
+		value, err := ioutil.ReadFile(xattrSidecar(path, attr))
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return string(value), err
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+// writeXattrSidecar records the extended attribute of the file in its sidecar
+// file. The sidecar file is replaced rather than written in place, as it may be
+// hard-linked to a snapshot or from a staging directory.
+func writeXattrSidecar(path, attr, value string) error {
+	return writeFileAtomic(xattrSidecar(path, attr), []byte(value))
+}
+
+// removeXattrSidecar removes the sidecar file of the extended attribute of the
+// file if any.
+func removeXattrSidecar(path, attr string) error {
+	if err := os.Remove(xattrSidecar(path, attr)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// xattrSidecar returns the sidecar file next to the file, or in the directory,
+// that records the extended attribute.
+func xattrSidecar(path, attr string) string {
+	if info, err := os.Lstat(path); err == nil && info.IsDir() {
+		return filepath.Join(path, xattrSidecarPrefix+attr)
+	}
+	return filepath.Join(filepath.Dir(path), xattrSidecarPrefix+filepath.Base(path)+"."+attr)
+}
+
+func isXattrSidecar(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), xattrSidecarPrefix)
+}
+
+func xattrUnsupported(err error) bool {
+	return err == unix.ENOTSUP || err == unix.EOPNOTSUPP
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// destination is where the objects are synced to. The files in a destination
+// are identified by their keys, which are the compare keys of the objects.
+type destination interface {
+	// list returns the files in the destination.
+	list(ctx context.Context) (*fileIterator, error)
+	// put replaces the file at the key with the content written by write,
+	// which is visible only once it is complete. The size is that of the
+	// object, or -1 if the content is decompressed from it. The ETag of the
+	// object is recorded if not empty.
+	put(ctx context.Context, key string, size int64, modTime time.Time, etag string, write func(downloadFile) error) error
+	// symlink replaces the file at the key with a symbolic link.
+	symlink(ctx context.Context, key, target string, modTime time.Time) error
+	// delete removes the file at the key.
+	delete(ctx context.Context, key string) error
+	// location returns the location of the file at the key in the log
+	// messages.
+	location(key string) string
+}
+
+// localDestination is a directory on the local file system. The files are
+// written to temporary files renamed over the destination files, so that the
+// readers never see partially written files.
+type localDestination struct {
+	path      string
+	exclude   string
+	readETags bool
+}
+
+func newLocalDestination(path, exclude string, readETags bool) *localDestination {
+	if !strings.HasSuffix(path, string(filepath.Separator)) {
+		path += string(filepath.Separator)
+	}
+	return &localDestination{path: path, exclude: exclude, readETags: readETags}
+}
+
+func (d *localDestination) list(ctx context.Context) (*fileIterator, error) {
+	if _, err := os.Stat(d.path); os.IsNotExist(err) {
+		return &fileIterator{}, nil
+	}
+
+	var files []*file
+	err := filepath.Walk(d.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && isSnapshotDir(path) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || path == d.exclude || isXattrSidecar(path) {
+			return nil
+		}
+
+		var link, etag string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if d.readETags {
+			if etag, err = getXattr(path, etagXattr); err != nil {
+				return err
+			}
+		}
+
+		files = append(files, &file{
+			compareKey: strings.TrimPrefix(path, d.path),
+			etag:       etag,
+			link:       link,
+			modTime:    info.ModTime(),
+			path:       path,
+			size:       info.Size(),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileIterator{files: files}, nil
+}
+
+func (d *localDestination) put(ctx context.Context, key string, size int64, modTime time.Time, etag string, write func(downloadFile) error) error {
+	dst := d.location(key)
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+
+	fileName := tempFileName(dst)
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := write(file); err != nil {
+		os.Remove(fileName)
+		return err
+	}
+
+	var sidecar bool
+	if etag != "" {
+		if err := setXattr(fileName, etagXattr, etag); xattrUnsupported(err) {
+			// The sidecar file is written once the file is in place, so
+			// that it never records the ETag of a file not yet replaced.
+			sidecar = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if err := commitFile(fileName, dst, modTime); err != nil {
+		return err
+	}
+
+	if sidecar {
+		return writeXattrSidecar(dst, etagXattr, etag)
+	}
+	return nil
+}
+
+func (d *localDestination) symlink(ctx context.Context, key, target string, modTime time.Time) error {
+	dst := d.location(key)
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+
+	fileName := tempFileName(dst)
+	if err := os.Symlink(target, fileName); err != nil {
+		return err
+	}
+
+	return commitFile(fileName, dst, modTime)
+}
+
+// commitFile sets the modification time of the temporary file and renames it
+// to the destination file.
+func commitFile(fileName, dst string, modTime time.Time) error {
+	if err := lchtimes(fileName, modTime); err != nil {
+		return err
+	}
+
+	return os.Rename(fileName, dst)
+}
+
+func (d *localDestination) delete(ctx context.Context, key string) error {
+	if err := os.Remove(d.location(key)); err != nil {
+		return err
+	}
+	return removeXattrSidecar(d.location(key), etagXattr)
+}
+
+func (d *localDestination) location(key string) string {
+	return filepath.Join(d.path, key)
+}
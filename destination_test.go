@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryDestination is a destination in memory.
+type memoryDestination struct {
+	files map[string]*memoryDestinationFile
+}
+
+type memoryDestinationFile struct {
+	content string
+	etag    string
+	link    string
+	modTime time.Time
+}
+
+func newMemoryDestination() *memoryDestination {
+	return &memoryDestination{files: make(map[string]*memoryDestinationFile)}
+}
+
+func (d *memoryDestination) list(ctx context.Context) (*fileIterator, error) {
+	var files []*file
+	for key, f := range d.files {
+		files = append(files, &file{
+			compareKey: key,
+			etag:       f.etag,
+			link:       f.link,
+			modTime:    f.modTime,
+			path:       key,
+			size:       int64(len(f.content)),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].compareKey < files[j].compareKey })
+	return &fileIterator{files: files}, nil
+}
+
+func (d *memoryDestination) put(ctx context.Context, key string, size int64, modTime time.Time, etag string, write func(downloadFile) error) error {
+	var file memoryFile
+	if err := write(&file); err != nil {
+		return err
+	}
+	d.files[key] = &memoryDestinationFile{content: string(file.data), etag: etag, modTime: modTime}
+	return nil
+}
+
+func (d *memoryDestination) symlink(ctx context.Context, key, target string, modTime time.Time) error {
+	d.files[key] = &memoryDestinationFile{link: target, modTime: modTime}
+	return nil
+}
+
+func (d *memoryDestination) delete(ctx context.Context, key string) error {
+	delete(d.files, key)
+	return nil
+}
+
+func (d *memoryDestination) location(key string) string {
+	return "memory:" + key
+}
+
+func TestSyncToMemoryDestination(t *testing.T) {
+	modTime := time.Now()
+	object1 := &testObject{content: "a", key: "prefix/key1", lastModified: modTime}
+	object1New := &testObject{content: "b", key: "prefix/key1", lastModified: modTime.Add(time.Second)}
+	object2 := &testObject{content: "cc", key: "prefix/key2", lastModified: modTime}
+
+	api := &s3Api{}
+	s := &syncer{bucket: "bucket", prefix: "prefix", limiter: newRateLimiter(nil, 0, 0), s3Api: api}
+	d := newMemoryDestination()
+
+	tests := []struct {
+		objects []*testObject
+		changed bool
+		want    map[string]string
+	}{
+		{objects: []*testObject{object1, object2}, changed: true, want: map[string]string{"key1": "a", "key2": "cc"}},
+		{objects: []*testObject{object1, object2}, changed: false, want: map[string]string{"key1": "a", "key2": "cc"}},
+		{objects: []*testObject{object1New}, changed: true, want: map[string]string{"key1": "b"}},
+	}
+
+	for i, test := range tests {
+		api.objects = test.objects
+		prefix, _, changed, err := s.syncTo(context.Background(), d)
+		if err != nil {
+			t.Fatalf("sync %d: %v", i, err)
+		}
+		if prefix != "prefix/" {
+			t.Errorf("sync %d, prefix: got %s, want prefix/", i, prefix)
+		}
+		if changed != test.changed {
+			t.Errorf("sync %d, changed: got %t, want %t", i, changed, test.changed)
+		}
+
+		got := make(map[string]string)
+		for key, f := range d.files {
+			got[key] = f.content
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("sync %d, files: got %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestLocalDestinationXattrSidecar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "destination_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "key1")
+	if err := ioutil.WriteFile(path, []byte("a"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeXattrSidecar(path, etagXattr, `"etag1"`); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newLocalDestination(dir, "", true)
+	files, err := d.list(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files.files) != 1 || files.files[0].compareKey != "key1" {
+		t.Errorf("files: got %+v, want key1 only", files.files)
+	}
+
+	// The sidecar file hard-linked to a staging directory is not modified
+	// when the one in the staging directory is written.
+	staging := dir + ".staging"
+	if err := os.Mkdir(staging, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(staging)
+	if err := linkTree(dir, staging); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeXattrSidecar(filepath.Join(staging, "key1"), etagXattr, `"etag2"`); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(xattrSidecar(path, etagXattr)); err != nil {
+		t.Error(err)
+	} else if string(got) != `"etag1"` {
+		t.Errorf("sidecar: got %s, want %s", got, `"etag1"`)
+	}
+
+	if err := d.delete(context.Background(), "key1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(xattrSidecar(path, etagXattr)); !os.IsNotExist(err) {
+		t.Errorf("sidecar: got %v, want removed", err)
+	}
+}
+
+// memoryFile is a file in memory to download an object into.
+type memoryFile struct {
+	data   []byte
+	offset int64
+	// mutex is held while writing to the file, as the parts of an object
+	// are downloaded concurrently.
+	mutex sync.Mutex
+}
+
+func (f *memoryFile) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memoryFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func (f *memoryFile) Read(p []byte) (int, error) {
+	if f.offset >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memoryFile) Truncate(size int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if size < int64(len(f.data)) {
+		f.data = f.data[:size]
+	}
+	return nil
+}
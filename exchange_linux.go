@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// exchangeDirs atomically exchanges the directories with renameat2(2), or
+// renames them one after the other if the file system does not support it.
+func exchangeDirs(a, b string) error {
+	p1, err := unix.BytePtrFromString(a)
+	if err != nil {
+		return err
+	}
+	p2, err := unix.BytePtrFromString(b)
+	if err != nil {
+		return err
+	}
+
+	fd := unix.AT_FDCWD
+	_, _, errno := unix.Syscall6(unix.SYS_RENAMEAT2, uintptr(fd), uintptr(unsafe.Pointer(p1)), uintptr(fd), uintptr(unsafe.Pointer(p2)), unix.RENAME_EXCHANGE, 0)
+	switch errno {
+	case 0:
+		return nil
+	case unix.ENOSYS, unix.EINVAL:
+		log.Printf("The file system of %s does not support exchanging directories atomically: %v. Renaming them one after the other, so that %s is missing in between...\n", b, errno, b)
+		return renameDirs(a, b)
+	default:
+		return &os.LinkError{Op: "renameat2", Old: a, New: b, Err: errno}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "log"
+
+// exchangeDirs exchanges the directories by renaming them one after the other,
+// as exchanging them atomically is only supported on Linux.
+func exchangeDirs(a, b string) error {
+	log.Printf("Exchanging directories atomically is not supported on this platform. Renaming them one after the other, so that %s is missing in between...\n", b)
+	return renameDirs(a, b)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const gcsEndpoint = "https://storage.googleapis.com"
+
+// gcsSource is a Google Cloud Storage bucket. The objects are read with the
+// access token of the service account of the instance, or anonymously if there
+// is no metadata server to obtain the token from.
+type gcsSource struct {
+	bucket   string
+	endpoint string
+	limiter  *rateLimiter
+	// token is nil once the objects are read anonymously.
+	token *tokenExchangeAuthenticator
+	mutex sync.Mutex
+}
+
+func newGCSSource(bucket string, limiter *rateLimiter) *gcsSource {
+	return &gcsSource{
+		bucket:   bucket,
+		endpoint: gcsEndpoint,
+		limiter:  limiter,
+		token:    &tokenExchangeAuthenticator{exchange: gcpAccessToken},
+	}
+}
+
+type gcsObjects struct {
+	Items []struct {
+		Name    string    `json:"name"`
+		Size    string    `json:"size"`
+		Updated time.Time `json:"updated"`
+		ETag    string    `json:"etag"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+func (s *gcsSource) list(ctx context.Context, prefix string) ([]*object, error) {
+	var objects []*object
+	var pageToken string
+	for {
+		query := url.Values{"prefix": {prefix}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		u := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", s.endpoint, url.PathEscape(s.bucket), query.Encode())
+
+		resp, err := s.get(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		var page gcsObjects
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error listing gs://%s/%s: %v", s.bucket, prefix, err)
+		}
+
+		for _, item := range page.Items {
+			size, err := strconv.ParseInt(item.Size, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size of gs://%s/%s: %v", s.bucket, item.Name, err)
+			}
+			objects = append(objects, &object{
+				etag:    item.ETag,
+				key:     item.Name,
+				modTime: item.Updated,
+				size:    size,
+			})
+		}
+
+		if page.NextPageToken == "" {
+			return objects, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (s *gcsSource) open(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", s.endpoint, url.PathEscape(s.bucket), url.PathEscape(key))
+	resp, err := s.get(ctx, u)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Body, resp.Header.Get("Content-Encoding"), nil
+}
+
+func (s *gcsSource) readLink(ctx context.Context, key string) (string, error) {
+	return readLink(ctx, s, s.limiter, key)
+}
+
+func (s *gcsSource) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Prevent the HTTP transport from transparently decompressing the
+	// objects stored with Content-Encoding: gzip.
+	req.Header.Set("Accept-Encoding", "identity")
+
+	token, err := s.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return getHTTP(ctx, s.limiter, req)
+}
+
+// accessToken returns the access token to read the objects with, or "" to
+// read them anonymously. The errors other than the lack of a metadata server
+// are returned, so that a temporary failure does not turn to anonymous reads.
+func (s *gcsSource) accessToken(ctx context.Context) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.token == nil {
+		return "", nil
+	}
+	basic, err := s.token.credentials(ctx)
+	if err == errNoMetadataServer {
+		log.Printf("Reading gs://%s anonymously: %v\n", s.bucket, err)
+		s.token = nil
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return basic.Password, nil
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/stream"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	// imageDestinationScheme is the prefix of the destinations that are
+	// container images in a registry instead of directories.
+	imageDestinationScheme = "docker://"
+	// dataLayerLabel is the label of the image recording the diff ID of the
+	// layer holding the synced files, which is replaced by every sync.
+	dataLayerLabel = labelPrefix + "data-layer"
+)
+
+func isImageDestination(dst string) bool {
+	return strings.HasPrefix(dst, imageDestinationScheme)
+}
+
+func parseImageDestination(dst string) (name.Reference, error) {
+	return name.ParseReference(strings.TrimPrefix(dst, imageDestinationScheme), name.WeakValidation)
+}
+
+// layerFile is a file in the data layer of an image destination.
+type layerFile struct {
+	header *tar.Header
+	// write writes the content of a regular file put by the sync, or is nil
+	// for the files kept from the previous data layer.
+	write func(downloadFile) error
+}
+
+// syncImage syncs the objects into the data layer of the image, which is the
+// last layer of the image if it was pushed by a previous sync or a new layer
+// appended to the image otherwise. The layer is streamed to the registry while
+// it is pushed, with the unchanged files copied from the previous data layer
+// and the new objects downloaded from S3, and the image is pushed only if it
+// changed.
+func (s *syncer) syncImage(ctx context.Context) (bool, error) {
+	ref, err := parseImageDestination(s.dst)
+	if err != nil {
+		return false, err
+	}
+	auth, err := s.keychain.resolve(ref.Context().Registry)
+	if err != nil {
+		return false, err
+	}
+	options := remoteOptions(ctx, auth)
+
+	image, err := remoteImage(ref, options)
+	if err != nil {
+		return false, err
+	}
+
+	base, layer, files, err := s.readDataLayer(image)
+	if err != nil {
+		return false, err
+	}
+
+	d := &imageDestination{ref: ref, prefix: s.imagePathPrefix(), layer: layer, files: files}
+	prefix, objects, changed, err := s.syncTo(ctx, d)
+	if err != nil {
+		return false, err
+	}
+
+	if changed || layer == nil {
+		log.Printf("Pushing %s...\n", ref)
+		if err := d.push(image, base, options); err != nil {
+			return false, err
+		}
+	}
+
+	s.result = newSyncResult(s.resolvedBucket, prefix, objects.objects)
+
+	return changed, nil
+}
+
+// remoteImage returns the image at the reference, or an empty image if it does
+// not exist. An image index is refused, as pushing an image to its tag would
+// replace the images of all the platforms with the one of a single platform.
+func remoteImage(ref name.Reference, options []remote.Option) (v1.Image, error) {
+	descriptor, err := remote.Get(ref, options...)
+	if isNotFound(err) {
+		log.Printf("Creating %s...\n", ref)
+		return empty.Image, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch descriptor.MediaType {
+	case types.DockerManifestList, types.OCIImageIndex:
+		return nil, fmt.Errorf("%s is an image index, which cannot be synced into; use the tag or the digest of the image of a platform instead", ref)
+	}
+	return descriptor.Image()
+}
+
+// isNotFound reports whether the error is returned by a registry for an image
+// or a repository that does not exist.
+func isNotFound(err error) bool {
+	e, ok := err.(*transport.Error)
+	if !ok || len(e.Errors) == 0 {
+		return false
+	}
+	for _, d := range e.Errors {
+		if d.Code != transport.ManifestUnknownErrorCode && d.Code != transport.NameUnknownErrorCode {
+			return false
+		}
+	}
+	return true
+}
+
+// imagePathPrefix returns the directory in the image the objects are synced
+// into, relative to the root and ending with a slash, or "" for the root.
+func (s *syncer) imagePathPrefix() string {
+	p := strings.Trim(path.Clean("/"+s.imagePath), "/")
+	if p == "" {
+		return ""
+	}
+	return p + "/"
+}
+
+// readDataLayer returns the layers of the image below the data layer, the data
+// layer, or nil if the image has no data layer, and the files in the data
+// layer by their compare keys. Only the headers of the files are read, and
+// their contents are copied from the data layer when the new one is pushed.
+func (s *syncer) readDataLayer(image v1.Image) ([]v1.Layer, v1.Layer, map[string]*layerFile, error) {
+	files := make(map[string]*layerFile)
+
+	configFile, err := image.ConfigFile()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	layers, err := image.Layers()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(layers) == 0 {
+		return layers, nil, files, nil
+	}
+
+	last := layers[len(layers)-1]
+	diffID, err := last.DiffID()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if configFile.Config.Labels[dataLayerLabel] != diffID.String() {
+		return layers, nil, files, nil
+	}
+
+	r, err := last.Uncompressed()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer r.Close()
+
+	prefix := s.imagePathPrefix()
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, nil, err
+		}
+
+		name := layerFileName(header)
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeSymlink {
+			continue
+		}
+
+		header.Name = name
+		files[strings.TrimPrefix(name, prefix)] = &layerFile{header: header}
+	}
+
+	return layers[:len(layers)-1], last, files, nil
+}
+
+// layerFileName returns the name of the file in a layer relative to the root.
+func layerFileName(header *tar.Header) string {
+	return strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+}
+
+// layerFileIterator returns an iterator over the files of the data layer in
+// the order of their compare keys.
+func layerFileIterator(files map[string]*layerFile) *fileIterator {
+	iterator := &fileIterator{}
+	for key, f := range files {
+		iterator.files = append(iterator.files, &file{
+			compareKey: key,
+			link:       f.header.Linkname,
+			modTime:    f.header.ModTime,
+			path:       f.header.Name,
+			size:       f.header.Size,
+		})
+	}
+	sort.Slice(iterator.files, func(i, j int) bool { return iterator.files[i].compareKey < iterator.files[j].compareKey })
+	return iterator
+}
+
+// imageDestination is the data layer of an image, whose files are written
+// to the new data layer when the image is pushed.
+type imageDestination struct {
+	ref name.Reference
+	// prefix is the directory of the files in the layer.
+	prefix string
+	// layer is the previous data layer holding the files kept by the sync, or
+	// nil if the image has none.
+	layer v1.Layer
+	files map[string]*layerFile
+}
+
+func (d *imageDestination) list(ctx context.Context) (*fileIterator, error) {
+	return layerFileIterator(d.files), nil
+}
+
+// put records the file to write to the layer, whose content is downloaded
+// only when the layer is streamed, so its size must be known beforehand.
+func (d *imageDestination) put(ctx context.Context, key string, size int64, modTime time.Time, etag string, write func(downloadFile) error) error {
+	if size < 0 {
+		return fmt.Errorf("cannot write %s of an unknown size", d.location(key))
+	}
+	d.files[key] = &layerFile{
+		header: &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     d.prefix + key,
+			Mode:     0644,
+			Size:     size,
+			ModTime:  modTime,
+		},
+		write: write,
+	}
+	return nil
+}
+
+func (d *imageDestination) symlink(ctx context.Context, key, target string, modTime time.Time) error {
+	d.files[key] = &layerFile{header: &tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     d.prefix + key,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  modTime,
+	}}
+	return nil
+}
+
+func (d *imageDestination) delete(ctx context.Context, key string) error {
+	delete(d.files, key)
+	return nil
+}
+
+func (d *imageDestination) location(key string) string {
+	return fmt.Sprintf("%s in %s", d.prefix+key, d.ref)
+}
+
+// writesSequentially reports that the files are streamed to the layer.
+func (d *imageDestination) writesSequentially() {}
+
+// push pushes the image whose data layer is replaced with the layer of the
+// files, or appended to the image if it has no data layer. The layer is
+// written to a pipe while it is pushed.
+func (d *imageDestination) push(image v1.Image, base []v1.Layer, options []remote.Option) error {
+	configFile, err := image.ConfigFile()
+	if err != nil {
+		return err
+	}
+	configFile = configFile.DeepCopy()
+	if d.layer == nil {
+		configFile.History = append(configFile.History, v1.History{
+			Created:   v1.Time{Time: time.Now()},
+			CreatedBy: "s3-sync",
+		})
+	}
+
+	r, w := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		err := d.writeLayer(w)
+		w.CloseWithError(err)
+		errCh <- err
+	}()
+
+	err = remote.Write(d.ref, &dataLayerImage{base: base, layer: stream.NewLayer(r), configFile: configFile}, options...)
+	// Stop writing the layer if the push failed.
+	r.Close()
+
+	if writeErr := <-errCh; writeErr != nil && writeErr != io.ErrClosedPipe {
+		return writeErr
+	}
+	return err
+}
+
+// writeLayer writes the files in the order of their names, with their parent
+// directories. The contents of the files kept by the sync are copied from the
+// previous data layer, and those of the files put by the sync are downloaded.
+func (d *imageDestination) writeLayer(w io.Writer) error {
+	names := make([]string, 0, len(d.files))
+	byName := make(map[string]*layerFile, len(d.files))
+	for _, f := range d.files {
+		names = append(names, f.header.Name)
+		byName[f.header.Name] = f
+	}
+	sort.Strings(names)
+
+	previous := &layerReader{layer: d.layer}
+	defer previous.close()
+
+	writer := newTarballWriter(w, tarballOptions{})
+	dirs := make(map[string]bool)
+	for _, n := range names {
+		elements := strings.Split(n, "/")
+		for i := range elements[:len(elements)-1] {
+			dir := strings.Join(elements[:i+1], "/")
+			if dirs[dir] {
+				continue
+			}
+			if err := addDirToTarball(writer, dir); err != nil {
+				return err
+			}
+			dirs[dir] = true
+		}
+
+		f := byName[n]
+		if err := writer.WriteHeader(f.header); err != nil {
+			return err
+		}
+		switch {
+		case f.header.Typeflag != tar.TypeReg:
+		case f.write != nil:
+			file := &streamFile{w: writer}
+			if err := f.write(file); err != nil {
+				return err
+			}
+			if file.offset != f.header.Size {
+				return fmt.Errorf("error writing %s: got %d bytes, want %d", n, file.offset, f.header.Size)
+			}
+		default:
+			r, err := previous.find(n)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(writer, r); err != nil {
+				return err
+			}
+		}
+	}
+	return writer.Close()
+}
+
+// layerReader reads the files of a layer, which are usually found in the
+// order they are looked up, as the layers are written in the order of the
+// names of the files.
+type layerReader struct {
+	layer  v1.Layer
+	r      io.ReadCloser
+	reader *tar.Reader
+	// rewound reports whether the layer was read again from the start since
+	// the last file was found.
+	rewound bool
+}
+
+// find returns the reader of the content of the regular file with the name,
+// reading the layer again from the start if it is not found after the last
+// file found.
+func (l *layerReader) find(name string) (io.Reader, error) {
+	if l.layer == nil {
+		return nil, fmt.Errorf("%s is missing in the data layer", name)
+	}
+	for {
+		if l.reader == nil {
+			r, err := l.layer.Uncompressed()
+			if err != nil {
+				return nil, err
+			}
+			l.r, l.reader = r, tar.NewReader(r)
+		}
+
+		header, err := l.reader.Next()
+		if err == io.EOF {
+			l.close()
+			if l.rewound {
+				return nil, fmt.Errorf("%s is missing in the data layer", name)
+			}
+			l.rewound = true
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag == tar.TypeReg && layerFileName(header) == name {
+			l.rewound = false
+			return l.reader, nil
+		}
+	}
+}
+
+func (l *layerReader) close() {
+	if l.r != nil {
+		l.r.Close()
+		l.r, l.reader = nil, nil
+	}
+}
+
+// dataLayerImage is an image whose data layer is streamed while it is pushed.
+// Its config file records the diff ID of the data layer, so the config file
+// and the manifest are available only once the layer is pushed.
+type dataLayerImage struct {
+	base  []v1.Layer
+	layer *stream.Layer
+	// configFile is the config file of the image without the data layer.
+	configFile *v1.ConfigFile
+
+	mutex sync.Mutex
+	image v1.Image
+}
+
+func (i *dataLayerImage) Layers() ([]v1.Layer, error) {
+	return append(append([]v1.Layer(nil), i.base...), i.layer), nil
+}
+
+func (i *dataLayerImage) MediaType() (types.MediaType, error) {
+	return types.DockerManifestSchema2, nil
+}
+
+func (i *dataLayerImage) ConfigName() (v1.Hash, error) {
+	image, err := i.pushed()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return image.ConfigName()
+}
+
+func (i *dataLayerImage) ConfigFile() (*v1.ConfigFile, error) {
+	image, err := i.pushed()
+	if err != nil {
+		return nil, err
+	}
+	return image.ConfigFile()
+}
+
+func (i *dataLayerImage) RawConfigFile() ([]byte, error) {
+	image, err := i.pushed()
+	if err != nil {
+		return nil, err
+	}
+	return image.RawConfigFile()
+}
+
+func (i *dataLayerImage) Digest() (v1.Hash, error) {
+	image, err := i.pushed()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return image.Digest()
+}
+
+func (i *dataLayerImage) Manifest() (*v1.Manifest, error) {
+	image, err := i.pushed()
+	if err != nil {
+		return nil, err
+	}
+	return image.Manifest()
+}
+
+func (i *dataLayerImage) RawManifest() ([]byte, error) {
+	image, err := i.pushed()
+	if err != nil {
+		return nil, err
+	}
+	return image.RawManifest()
+}
+
+func (i *dataLayerImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	image, err := i.pushed()
+	if err != nil {
+		return nil, err
+	}
+	return image.LayerByDigest(h)
+}
+
+func (i *dataLayerImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	image, err := i.pushed()
+	if err != nil {
+		return nil, err
+	}
+	return image.LayerByDiffID(h)
+}
+
+// pushed returns the image with the config file labeled with the diff ID of
+// the data layer, or stream.ErrNotComputed until the layer is pushed.
+func (i *dataLayerImage) pushed() (v1.Image, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if i.image != nil {
+		return i.image, nil
+	}
+	diffID, err := i.layer.DiffID()
+	if err != nil {
+		return nil, err
+	}
+
+	layers, err := i.Layers()
+	if err != nil {
+		return nil, err
+	}
+	configFile := i.configFile.DeepCopy()
+	configFile.RootFS.Type = "layers"
+	configFile.RootFS.DiffIDs = nil
+	for _, l := range layers {
+		d, err := l.DiffID()
+		if err != nil {
+			return nil, err
+		}
+		configFile.RootFS.DiffIDs = append(configFile.RootFS.DiffIDs, d)
+	}
+
+	if configFile.Config.Labels == nil {
+		configFile.Config.Labels = make(map[string]string)
+	}
+	configFile.Config.Labels[dataLayerLabel] = diffID.String()
+	configFile.Created = v1.Time{Time: time.Now()}
+
+	image, err := mutate.AppendLayers(empty.Image, layers...)
+	if err != nil {
+		return nil, err
+	}
+	if i.image, err = mutate.ConfigFile(image, configFile); err != nil {
+		return nil, err
+	}
+	return i.image, nil
+}
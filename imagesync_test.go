@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestSyncImage(t *testing.T) {
+	registry := newTestRegistry()
+	defer registry.Close()
+
+	ref, err := name.NewTag(registry.host()+"/repo:data", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := random.Image(16, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, base); err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Now().Truncate(time.Second)
+	object1 := &testObject{content: "a", key: "prefix/key1", lastModified: modTime}
+	object2 := &testObject{content: "bb", key: "prefix/dir/key2", lastModified: modTime}
+	object1New := &testObject{content: "c", key: "prefix/key1", lastModified: modTime.Add(time.Second)}
+	object3 := &testObject{content: "ddd", key: "prefix/key3", lastModified: modTime}
+
+	api := &s3Api{}
+	s := &syncer{
+		bucket:    "bucket",
+		prefix:    "prefix",
+		dst:       imageDestinationScheme + ref.String(),
+		imagePath: "/data",
+		limiter:   newRateLimiter(nil, 0, 0),
+		s3Api:     api,
+		keychain:  newKeychain(nil, nil),
+	}
+
+	tests := []struct {
+		objects []*testObject
+		changed bool
+		want    map[string]string
+	}{
+		{
+			objects: []*testObject{object2, object1},
+			changed: true,
+			want:    map[string]string{"data/dir/key2": "bb", "data/key1": "a"},
+		},
+		{
+			objects: []*testObject{object2, object1},
+			changed: false,
+			want:    map[string]string{"data/dir/key2": "bb", "data/key1": "a"},
+		},
+		{
+			// The unchanged file is copied from the previous data layer.
+			objects: []*testObject{object2, object1New},
+			changed: true,
+			want:    map[string]string{"data/dir/key2": "bb", "data/key1": "c"},
+		},
+		{
+			objects: []*testObject{object1New, object3},
+			changed: true,
+			want:    map[string]string{"data/key1": "c", "data/key3": "ddd"},
+		},
+	}
+
+	for i, test := range tests {
+		api.objects = test.objects
+		changed, err := s.sync(context.Background())
+		if err != nil {
+			t.Fatalf("sync %d: %v", i, err)
+		}
+		if changed != test.changed {
+			t.Errorf("sync %d, changed: got %t, want %t", i, changed, test.changed)
+		}
+
+		image, err := remote.Image(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers, err := image.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(layers) != 2 {
+			t.Fatalf("sync %d, layers: got %d, want 2", i, len(layers))
+		}
+
+		r, err := layers[1].Uncompressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]string)
+		reader := tar.NewReader(r)
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if header.Typeflag != tar.TypeReg {
+				continue
+			}
+			content, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[header.Name] = string(content)
+		}
+		r.Close()
+
+		if !reflect.DeepEqual(files, test.want) {
+			t.Errorf("sync %d, files: got %v, want %v", i, files, test.want)
+		}
+	}
+}
+
+func TestSyncImageIndex(t *testing.T) {
+	registry := newTestRegistry()
+	defer registry.Close()
+
+	ref, err := name.NewTag(registry.host()+"/repo:data", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := random.Index(16, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(ref, index); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &syncer{
+		bucket:   "bucket",
+		prefix:   "prefix",
+		dst:      imageDestinationScheme + ref.String(),
+		limiter:  newRateLimiter(nil, 0, 0),
+		s3Api:    &s3Api{objects: []*testObject{{content: "a", key: "prefix/key1"}}},
+		keychain: newKeychain(nil, nil),
+	}
+	if _, err := s.sync(context.Background()); err == nil || !strings.Contains(err.Error(), "image index") {
+		t.Fatalf("image index: got %v, want an error", err)
+	}
+
+	// The index is left as is.
+	if _, err := remote.Index(ref); err != nil {
+		t.Error(err)
+	}
+}
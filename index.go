@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func parsePlatform(s string) (v1.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return v1.Platform{}, fmt.Errorf("invalid platform '%s' must be in the form of os/arch[/variant]", s)
+	}
+
+	platform := v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+func platformString(p v1.Platform) string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// imageIndex is an image index that references an image for each platform.
+type imageIndex struct {
+	images   map[v1.Hash]v1.Image
+	manifest *v1.IndexManifest
+}
+
+var _ v1.ImageIndex = (*imageIndex)(nil)
+
+func newImageIndex(images []v1.Image, platforms []v1.Platform, annotations map[string]string) (*imageIndex, error) {
+	index := &imageIndex{
+		images: make(map[v1.Hash]v1.Image, len(images)),
+		manifest: &v1.IndexManifest{
+			SchemaVersion: 2,
+			MediaType:     types.OCIImageIndex,
+			Annotations:   annotations,
+		},
+	}
+
+	for i, image := range images {
+		mediaType, err := image.MediaType()
+		if err != nil {
+			return nil, err
+		}
+		if mediaType == types.DockerManifestSchema2 {
+			// Docker manifests can only be referenced by a Docker manifest list.
+			index.manifest.MediaType = types.DockerManifestList
+		}
+
+		raw, err := image.RawManifest()
+		if err != nil {
+			return nil, err
+		}
+		digest, err := image.Digest()
+		if err != nil {
+			return nil, err
+		}
+
+		platform := platforms[i]
+		index.manifest.Manifests = append(index.manifest.Manifests, v1.Descriptor{
+			MediaType: mediaType,
+			Size:      int64(len(raw)),
+			Digest:    digest,
+			Platform:  &platform,
+		})
+		index.images[digest] = image
+	}
+
+	return index, nil
+}
+
+// MediaType implements v1.ImageIndex
+func (i *imageIndex) MediaType() (types.MediaType, error) {
+	return i.manifest.MediaType, nil
+}
+
+// Digest implements v1.ImageIndex
+func (i *imageIndex) Digest() (v1.Hash, error) {
+	return partial.Digest(i)
+}
+
+// IndexManifest implements v1.ImageIndex
+func (i *imageIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return i.manifest, nil
+}
+
+// RawManifest implements v1.ImageIndex
+func (i *imageIndex) RawManifest() ([]byte, error) {
+	return json.Marshal(i.manifest)
+}
+
+// Image implements v1.ImageIndex
+func (i *imageIndex) Image(h v1.Hash) (v1.Image, error) {
+	if image, ok := i.images[h]; ok {
+		return image, nil
+	}
+	return nil, fmt.Errorf("image %s not found in the index", h)
+}
+
+// ImageIndex implements v1.ImageIndex
+func (i *imageIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	return nil, fmt.Errorf("image index %s not found in the index", h)
+}
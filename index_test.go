@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestParsePlatform(t *testing.T) {
+	for _, s := range []string{"linux/amd64", "linux/arm64/v8"} {
+		platform, err := parsePlatform(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if platformString(platform) != s {
+			t.Errorf("platformString(parsePlatform(%q)): got %q", s, platformString(platform))
+		}
+	}
+
+	for _, s := range []string{"linux", "linux/", "linux/arm64/v8/x"} {
+		if _, err := parsePlatform(s); err == nil {
+			t.Errorf("parsePlatform(%q): expected an error", s)
+		}
+	}
+}
+
+func TestNewImageIndex(t *testing.T) {
+	platforms := []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}}
+
+	var images []v1.Image
+	for range platforms {
+		image, err := random.Image(10, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, image)
+	}
+
+	index, err := newImageIndex(images, platforms, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Manifests) != len(images) {
+		t.Fatalf("manifests: got %d, want %d", len(manifest.Manifests), len(images))
+	}
+
+	for i, desc := range manifest.Manifests {
+		if desc.Platform.Architecture != platforms[i].Architecture {
+			t.Errorf("manifests[%d].platform: got %v, want %v", i, desc.Platform, platforms[i])
+		}
+
+		image, err := index.Image(desc.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if image != images[i] {
+			t.Errorf("index.Image(%s): got a different image", desc.Digest)
+		}
+	}
+}
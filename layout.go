@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	imageOutputRegistry      = "registry"
+	imageOutputOCI           = "oci"
+	imageOutputDockerArchive = "docker-archive"
+)
+
+// imageRefNameAnnotation is the annotation of the descriptors in the
+// index.json of an OCI image layout that holds the name of the reference.
+const imageRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// imageOutput is where the builder writes the images to.
+type imageOutput struct {
+	kind string
+	path string
+}
+
+func parseImageOutput(s string) (imageOutput, error) {
+	if s == "" || s == imageOutputRegistry {
+		return imageOutput{kind: imageOutputRegistry}, nil
+	}
+
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return imageOutput{}, fmt.Errorf("invalid image output '%s'", s)
+	}
+
+	switch parts[0] {
+	case imageOutputOCI, imageOutputDockerArchive:
+		return imageOutput{kind: parts[0], path: parts[1]}, nil
+	default:
+		return imageOutput{}, fmt.Errorf("unknown image output '%s'", parts[0])
+	}
+}
+
+// writeDockerArchive writes the image to a tarball that can be loaded by
+// `docker load`, tagged with all the tags.
+func writeDockerArchive(path string, artifact digester, tags []name.Tag) error {
+	image, ok := artifact.(v1.Image)
+	if !ok {
+		return fmt.Errorf("docker-archive output does not support image indexes")
+	}
+
+	refToImage := make(map[name.Reference]v1.Image, len(tags))
+	for _, tag := range tags {
+		refToImage[tag] = image
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err := tarball.MultiRefWrite(refToImage, file); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// writeLayout writes the image or the image index to the OCI image layout at
+// the path, and references it from the index.json of the layout by the tags.
+func writeLayout(path string, artifact digester, tags []name.Tag) error {
+	if err := os.MkdirAll(filepath.Join(path, "blobs", "sha256"), os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(filepath.Join(path, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+
+	var desc v1.Descriptor
+	var err error
+	switch artifact := artifact.(type) {
+	case v1.ImageIndex:
+		desc, err = writeLayoutIndex(path, artifact)
+	case v1.Image:
+		desc, err = writeLayoutImage(path, artifact)
+	}
+	if err != nil {
+		return err
+	}
+
+	index := v1.IndexManifest{SchemaVersion: 2}
+	data, err := ioutil.ReadFile(filepath.Join(path, "index.json"))
+	if err == nil {
+		if err := json.Unmarshal(data, &index); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	refNames := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		refNames[tag.TagStr()] = true
+	}
+
+	manifests := index.Manifests[:0]
+	for _, m := range index.Manifests {
+		if !refNames[m.Annotations[imageRefNameAnnotation]] {
+			manifests = append(manifests, m)
+		}
+	}
+	for _, tag := range tags {
+		d := desc
+		d.Annotations = map[string]string{imageRefNameAnnotation: tag.TagStr()}
+		manifests = append(manifests, d)
+	}
+	index.Manifests = manifests
+
+	if data, err = json.Marshal(&index); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(path, "index.json"), data)
+}
+
+func writeLayoutIndex(path string, index v1.ImageIndex) (v1.Descriptor, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	for _, m := range manifest.Manifests {
+		image, err := index.Image(m.Digest)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		if _, err := writeLayoutImage(path, image); err != nil {
+			return v1.Descriptor{}, err
+		}
+	}
+
+	return writeLayoutManifest(path, index)
+}
+
+func writeLayoutImage(path string, image v1.Image) (v1.Descriptor, error) {
+	layers, err := image.Layers()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+
+		r, err := layer.Compressed()
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		err = writeLayoutBlob(path, digest, r)
+		r.Close()
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+	}
+
+	configName, err := image.ConfigName()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	config, err := image.RawConfigFile()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	if err := writeLayoutBlob(path, configName, bytes.NewReader(config)); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	return writeLayoutManifest(path, image)
+}
+
+type manifester interface {
+	MediaType() (types.MediaType, error)
+	Digest() (v1.Hash, error)
+	RawManifest() ([]byte, error)
+}
+
+func writeLayoutManifest(path string, m manifester) (v1.Descriptor, error) {
+	mediaType, err := m.MediaType()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	digest, err := m.Digest()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	raw, err := m.RawManifest()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	if err := writeLayoutBlob(path, digest, bytes.NewReader(raw)); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	return v1.Descriptor{MediaType: mediaType, Size: int64(len(raw)), Digest: digest}, nil
+}
+
+// writeLayoutBlob writes the blob to the layout unless it already exists.
+func writeLayoutBlob(path string, digest v1.Hash, r io.Reader) error {
+	blob := filepath.Join(path, "blobs", digest.Algorithm, digest.Hex)
+	if _, err := os.Stat(blob); err == nil {
+		return nil
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(blob), "."+digest.Hex)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), blob)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	// maxLinkDepth is the maximum number of links followed to resolve a
+	// link that refers to another link.
+	maxLinkDepth = 16
+	// maxConcurrentLinkReads is the maximum number of the link objects under
+	// the resolved prefix read concurrently.
+	maxConcurrentLinkReads = 16
+)
+
+// errNotModified is returned by readLinkObject when the link object has the
+// ETag it is read with.
+var errNotModified = errors.New("not modified")
+
+// link is the content of a link object. The target is either a path relative
+// to the link object or an s3://bucket/key URL, and is written either as it is
+// or as a JSON object such as
+//
+//	{"target": "s3://bucket/channels/stable", "versionId": "..."}
+//
+// The version ID pins the version of the target read as a link object.
+type link struct {
+	Target    string `json:"target"`
+	VersionID string `json:"versionId"`
+}
+
+func parseLink(content string) (*link, error) {
+	if !strings.HasPrefix(strings.TrimSpace(content), "{") {
+		return &link{Target: content}, nil
+	}
+
+	var l link
+	if err := json.Unmarshal([]byte(content), &l); err != nil {
+		return nil, err
+	}
+	if l.Target == "" {
+		return nil, fmt.Errorf("no target")
+	}
+	return &l, nil
+}
+
+// resolve returns the bucket and the key of the target of the link object at
+// the key in the bucket.
+func (l *link) resolve(bucket, key string) (string, string) {
+	if strings.HasPrefix(l.Target, "s3://") {
+		return parseS3URL(l.Target)
+	}
+	return bucket, path.Join(path.Dir(key), l.Target)
+}
+
+// resolveLinks resolves the links in the key one path element at a time, and
+// returns the bucket and the key it resolved to.
+func (s *syncer) resolveLinks(ctx context.Context, key string) (string, string, error) {
+	bucket := s.bucket
+	if s.linkObjectKeyRegexp == nil {
+		return bucket, key, nil
+	}
+
+	var k string
+	for _, c := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+		if len(k) > 0 {
+			k += "/"
+		}
+		k += c
+		if s.linkObjectKeyRegexp.MatchString(k) {
+			var err error
+			if bucket, k, err = s.followLinks(ctx, bucket, k); err != nil {
+				return "", "", err
+			}
+		}
+	}
+	return bucket, k, nil
+}
+
+// followLinks follows the link at the key and the links it refers to, and
+// returns the bucket and the key of the first target that is not a link.
+func (s *syncer) followLinks(ctx context.Context, bucket, key string) (string, string, error) {
+	var versionID string
+	visited := make(map[string]bool)
+	for {
+		location := sourceLocation(s.src, bucket, key)
+		if visited[location] {
+			return "", "", fmt.Errorf("link %s is in a cycle", location)
+		}
+		if len(visited) >= maxLinkDepth {
+			return "", "", fmt.Errorf("too many links to follow to resolve %s", location)
+		}
+		visited[location] = true
+
+		content, err := s.readLink(ctx, bucket, key, versionID)
+		if err != nil {
+			return "", "", err
+		}
+		l, err := parseLink(content)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid link %s: %v", location, err)
+		}
+
+		bucket, key = l.resolve(bucket, key)
+		versionID = l.VersionID
+		if !s.linkObjectKeyRegexp.MatchString(key) {
+			if versionID != "" {
+				return "", "", fmt.Errorf("link %s has a version ID of %s, which is not a link", location, sourceLocation(s.src, bucket, key))
+			}
+			return bucket, key, nil
+		}
+	}
+}
+
+// readLink reads the content of the link object at the key in the bucket, or
+// of its version if the version ID is not empty. The link objects in S3 are
+// read again only if their ETags changed since the last read.
+func (s *syncer) readLink(ctx context.Context, bucket, key, versionID string) (string, error) {
+	if s.source == nil {
+		location := sourceLocation(s.src, bucket, key)
+		if versionID != "" {
+			location += "?versionId=" + versionID
+		}
+
+		cached := s.links.get(location)
+		if cached != nil && versionID != "" {
+			// A version of an object never changes.
+			return cached.content, nil
+		}
+		var etag string
+		if cached != nil {
+			etag = cached.etag
+		}
+
+		content, etag, err := readLinkObject(ctx, s.s3Api, s.limiter, bucket, key, versionID, etag)
+		if err == errNotModified {
+			return cached.content, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		s.links.put(location, &cachedLink{content: content, etag: etag})
+		return content, nil
+	}
+
+	if bucket != s.bucket {
+		return "", fmt.Errorf("cannot follow a link to s3://%s/%s from %s", bucket, key, s.src)
+	}
+	if versionID != "" {
+		return "", fmt.Errorf("cannot read version %s of %s", versionID, sourceLocation(s.src, bucket, key))
+	}
+	return s.source.readLink(ctx, key)
+}
+
+// readSymlinks reads the link objects among the objects under the resolved
+// prefix concurrently, and sets the targets of the symbolic links created for
+// them. Once a read fails, the reads in progress are cancelled and no more are
+// started.
+func (s *syncer) readSymlinks(ctx context.Context, objects []*object) error {
+	var links []*object
+	for _, o := range objects {
+		if s.linkObjectKeyRegexp.MatchString(o.key) {
+			links = append(links, o)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var firstErr error
+	var once sync.Once
+	semaphore := make(chan struct{}, maxConcurrentLinkReads)
+	var wg sync.WaitGroup
+schedule:
+	for _, o := range links {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			break schedule
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(o *object) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			link, err := s.readSymlink(ctx, o)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			o.link = link
+		}(o)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// readSymlink returns the target of the symbolic link created for the link
+// object under the resolved prefix, which cannot be in a bucket. The link
+// object is read again only if its ETag in the listing changed since the
+// last read.
+func (s *syncer) readSymlink(ctx context.Context, o *object) (string, error) {
+	location := s.location(o.key)
+
+	var content string
+	if cached := s.links.get(location); cached != nil && o.etag != "" && cached.etag == o.etag {
+		content = cached.content
+	} else {
+		var err error
+		if content, err = s.objectSource().readLink(ctx, o.key); err != nil {
+			return "", err
+		}
+		s.links.put(location, &cachedLink{content: content, etag: o.etag})
+	}
+
+	l, err := parseLink(content)
+	if err != nil {
+		return "", fmt.Errorf("invalid link %s: %v", location, err)
+	}
+	if strings.HasPrefix(l.Target, "s3://") {
+		return "", fmt.Errorf("link %s under the prefix cannot refer to %s", location, l.Target)
+	}
+	return l.Target, nil
+}
+
+// readLinkObject reads the link object and returns its content and ETag. If
+// the ETag is not empty, the object is read only if its ETag is different, and
+// errNotModified is returned otherwise.
+func readLinkObject(ctx context.Context, s3Api s3iface.S3API, limiter *rateLimiter, bucket, key, versionID, etag string) (string, string, error) {
+	input := s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	if etag != "" {
+		input.IfNoneMatch = aws.String(etag)
+	}
+	output, err := s3Api.GetObjectWithContext(ctx, &input, limiter.requestOptions()...)
+	if e, ok := err.(awserr.RequestFailure); ok && etag != "" && e.StatusCode() == http.StatusNotModified {
+		return "", "", errNotModified
+	}
+	if err != nil {
+		return "", "", err
+	}
+	defer output.Body.Close()
+
+	body, err := ioutil.ReadAll(limiter.reader(ctx, output.Body))
+	if err != nil {
+		return "", "", err
+	}
+
+	return strings.TrimRight(string(body), "\r\n"), aws.StringValue(output.ETag), nil
+}
+
+// linkCache is the contents of the link objects by their locations, which are
+// kept as long as the links are read by every sync.
+type linkCache struct {
+	links map[string]*cachedLink
+	// used are the locations of the links read since the last prune.
+	used  map[string]bool
+	mutex sync.Mutex
+}
+
+type cachedLink struct {
+	content string
+	etag    string
+}
+
+func newLinkCache() *linkCache {
+	return &linkCache{links: make(map[string]*cachedLink), used: make(map[string]bool)}
+}
+
+func (c *linkCache) get(location string) *cachedLink {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.used[location] = true
+	return c.links[location]
+}
+
+func (c *linkCache) put(location string, link *cachedLink) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.used[location] = true
+	c.links[location] = link
+}
+
+// prune removes the links not read since the last prune.
+func (c *linkCache) prune() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for location := range c.links {
+		if !c.used[location] {
+			delete(c.links, location)
+		}
+	}
+	c.used = make(map[string]bool)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestResolveLinks(t *testing.T) {
+	links := map[string]map[string]*testObject{
+		"bucket": {
+			"channels/latest":              {content: "stable"},
+			"channels/stable":              {content: `{"target": "s3://other/releases/current"}`},
+			"channels/pinned":              {content: `{"target": "stable", "versionId": "v1"}`},
+			"channels/stable?versionId=v1": {content: "../releases/1"},
+			"channels/cycle1":              {content: "cycle2"},
+			"channels/cycle2":              {content: "cycle1"},
+			"channels/bad-version":         {content: `{"target": "../releases/1", "versionId": "v1"}`},
+			"channels/invalid":             {content: `{"versionId": "v1"}`},
+			"channels/deep" + strings.Repeat("p", maxLinkDepth): {content: "../releases/1"},
+		},
+		"other": {
+			"releases/current": {content: "2\n"},
+		},
+	}
+	for i := 0; i < maxLinkDepth; i++ {
+		links["bucket"][fmt.Sprintf("channels/deep%s", strings.Repeat("p", i))] = &testObject{content: "deep" + strings.Repeat("p", i+1)}
+	}
+
+	s := &syncer{
+		bucket:              "bucket",
+		linkObjectKeyRegexp: regexp.MustCompile(`^channels/[^/]+$|^releases/current$`),
+		s3Api:               &bucketApi{buckets: links},
+	}
+
+	tests := []struct {
+		key    string
+		bucket string
+		want   string
+	}{
+		{key: "channels/latest/data", bucket: "other", want: "releases/2/data"},
+		{key: "channels/pinned", bucket: "bucket", want: "releases/1"},
+		{key: "releases/1", bucket: "bucket", want: "releases/1"},
+	}
+	for _, test := range tests {
+		bucket, key, err := s.resolveLinks(context.Background(), test.key)
+		if err != nil {
+			t.Errorf("%s: %v", test.key, err)
+			continue
+		}
+		if bucket != test.bucket || key != test.want {
+			t.Errorf("%s: got s3://%s/%s, want s3://%s/%s", test.key, bucket, key, test.bucket, test.want)
+		}
+	}
+
+	for _, key := range []string{"channels/cycle1", "channels/bad-version", "channels/invalid", "channels/deep"} {
+		if _, _, err := s.resolveLinks(context.Background(), key); err == nil {
+			t.Errorf("%s: got no error", key)
+		}
+	}
+}
+
+func TestReadLinksWithCache(t *testing.T) {
+	api := &bucketApi{buckets: map[string]map[string]*testObject{
+		"bucket": {
+			"channels/current":        {content: "../releases/1", etag: "c1"},
+			"releases/1/a":            {content: "a"},
+			"releases/1/dir/current":  {content: "../a", etag: "l1"},
+			"releases/1/dir2/current": {content: "../a", etag: "l2"},
+		},
+	}}
+	s := &syncer{
+		bucket:              "bucket",
+		prefix:              "channels/current",
+		linkObjectKeyRegexp: regexp.MustCompile(`(^|/)current$`),
+		s3Api:               api,
+		links:               newLinkCache(),
+	}
+
+	tests := []struct {
+		update func()
+		reads  int32
+	}{
+		{update: func() {}, reads: 3},
+		{update: func() {}, reads: 0},
+		{update: func() { api.buckets["bucket"]["releases/1/dir/current"] = &testObject{content: "../dir2", etag: "l3"} }, reads: 1},
+		{update: func() { api.buckets["bucket"]["channels/current"].etag = "c2" }, reads: 1},
+	}
+
+	for i, test := range tests {
+		test.update()
+		api.reads = 0
+		prefix, objects, err := s.listObjects(context.Background())
+		if err != nil {
+			t.Fatalf("list %d: %v", i, err)
+		}
+		if prefix != "releases/1/" {
+			t.Errorf("list %d, prefix: got %s, want releases/1/", i, prefix)
+		}
+		if api.reads != test.reads {
+			t.Errorf("list %d, reads: got %d, want %d", i, api.reads, test.reads)
+		}
+		if link := objects.objects[1].link; i >= 2 && link != "../dir2" {
+			t.Errorf("list %d, link: got %s, want ../dir2", i, link)
+		}
+	}
+}
+
+func TestReadSymlinksStopOnError(t *testing.T) {
+	api := &bucketApi{buckets: map[string]map[string]*testObject{"bucket": {}}}
+	var objects []*object
+	for i := 0; i < maxConcurrentLinkReads*4; i++ {
+		key := fmt.Sprintf("releases/1/%d/current", i)
+		// A link under the prefix cannot refer to another bucket.
+		api.buckets["bucket"][key] = &testObject{content: "s3://other/releases/1"}
+		objects = append(objects, &object{key: key})
+	}
+	s := &syncer{
+		bucket:              "bucket",
+		linkObjectKeyRegexp: regexp.MustCompile(`(^|/)current$`),
+		s3Api:               api,
+		links:               newLinkCache(),
+	}
+
+	if err := s.readSymlinks(context.Background(), objects); err == nil {
+		t.Fatal("got no error")
+	}
+	if api.reads > maxConcurrentLinkReads {
+		t.Errorf("reads: got %d, want at most %d", api.reads, maxConcurrentLinkReads)
+	}
+}
@@ -8,36 +8,87 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
 )
 
 type syncSpec struct {
-	schedule            string
-	region              string
-	bucket              string
-	prefix              string
-	dst                 string
-	onStart             bool
-	linkObjectKeyRegexp *regexp.Regexp
+	name                 string
+	schedule             string
+	region               string
+	src                  *url.URL
+	bucket               string
+	prefix               string
+	dst                  string
+	dstRegion            string
+	imagePath            string
+	onStart              bool
+	linkObjectKeyRegexp  *regexp.Regexp
+	marker               string
+	checksum             string
+	maxBandwidth         int64
+	maxRequestsPerSecond float64
+	decompress           string
+	stripExtension       bool
+	archive              bool
+	onRelease            string
 }
 
 func (s *syncSpec) toCSV() (string, error) {
 	var record []string
+	if s.name != "" {
+		record = append(record, "name="+s.name)
+	}
 	if s.schedule != "" {
 		record = append(record, "schedule="+s.schedule)
 	}
 	if s.region != "" {
 		record = append(record, "region="+s.region)
 	}
-	record = append(record, "bucket="+s.bucket)
-	record = append(record, "prefix="+s.prefix)
+	if s.src != nil {
+		record = append(record, "src="+s.src.String())
+	} else {
+		record = append(record, "bucket="+s.bucket)
+		record = append(record, "prefix="+s.prefix)
+	}
 	record = append(record, "dst="+s.dst)
+	if s.dstRegion != "" {
+		record = append(record, "dst-region="+s.dstRegion)
+	}
+	if s.imagePath != "" {
+		record = append(record, "image-path="+s.imagePath)
+	}
 	record = append(record, fmt.Sprintf("on-start=%t", s.onStart))
 	record = append(record, fmt.Sprintf("link-object-key-pattern=%s", s.linkObjectKeyRegexp))
+	if s.marker != "" {
+		record = append(record, "marker="+s.marker)
+	}
+	if s.checksum != "" {
+		record = append(record, "checksum="+s.checksum)
+	}
+	if s.maxBandwidth > 0 {
+		record = append(record, fmt.Sprintf("max-bandwidth=%d", s.maxBandwidth))
+	}
+	if s.maxRequestsPerSecond > 0 {
+		record = append(record, "max-requests-per-second="+strconv.FormatFloat(s.maxRequestsPerSecond, 'g', -1, 64))
+	}
+	if s.decompress != "" {
+		record = append(record, "decompress="+s.decompress)
+		record = append(record, fmt.Sprintf("strip-extension=%t", s.stripExtension))
+	}
+	if s.archive {
+		record = append(record, "archive=true")
+	}
+	if s.onRelease != "" {
+		record = append(record, "on-release="+s.onRelease)
+	}
 
 	var b bytes.Buffer
 	w := csv.NewWriter(&b)
@@ -61,16 +112,37 @@ func (s *syncSpec) fromCSV(str string) error {
 		if len(parts) == 2 {
 			key, value := parts[0], parts[1]
 			switch key {
+			case "name":
+				s.name = value
 			case "schedule":
 				s.schedule = value
 			case "region":
 				s.region = value
+			case "src":
+				u, err := parseSourceURL(value)
+				if err != nil {
+					return err
+				}
+				if u.Scheme == "s3" {
+					s.bucket = u.Host
+					s.prefix = strings.TrimPrefix(u.Path, "/")
+				} else {
+					s.src = u
+					s.prefix = sourcePrefix(u)
+				}
 			case "bucket":
 				s.bucket = value
 			case "prefix":
 				s.prefix = value
 			case "dst":
 				s.dst = value
+			case "dst-region":
+				s.dstRegion = value
+			case "image-path":
+				if !filepath.IsAbs(value) {
+					return fmt.Errorf("image path '%s' must be an absolute path", value)
+				}
+				s.imagePath = value
 			case "on-start":
 				if s.onStart, err = strconv.ParseBool(value); err != nil {
 					return err
@@ -79,6 +151,36 @@ func (s *syncSpec) fromCSV(str string) error {
 				if s.linkObjectKeyRegexp, err = regexp.Compile(value); err != nil {
 					return err
 				}
+			case "marker":
+				s.marker = value
+			case "checksum":
+				if err := validateChecksumAlgorithm(value); err != nil {
+					return err
+				}
+				s.checksum = value
+			case "max-bandwidth":
+				if s.maxBandwidth, err = strconv.ParseInt(value, 10, 64); err != nil {
+					return err
+				}
+			case "max-requests-per-second":
+				if s.maxRequestsPerSecond, err = strconv.ParseFloat(value, 64); err != nil {
+					return err
+				}
+			case "decompress":
+				if err := validateDecompressMode(value); err != nil {
+					return err
+				}
+				s.decompress = value
+			case "strip-extension":
+				if s.stripExtension, err = strconv.ParseBool(value); err != nil {
+					return err
+				}
+			case "archive":
+				if s.archive, err = strconv.ParseBool(value); err != nil {
+					return err
+				}
+			case "on-release":
+				s.onRelease = value
 			default:
 				return fmt.Errorf("unexpected key '%s' in '%s'", key, field)
 			}
@@ -119,44 +221,220 @@ func (v *syncValue) Set(value string) error {
 		return err
 	}
 
-	if s.bucket == "" {
-		return fmt.Errorf("bucket is required")
-	}
-	if s.prefix == "" {
-		return fmt.Errorf("prefix is required")
+	if s.src == nil {
+		if s.bucket == "" {
+			return fmt.Errorf("bucket is required")
+		}
+		if s.prefix == "" {
+			return fmt.Errorf("prefix is required")
+		}
+	} else {
+		if s.bucket != "" {
+			return fmt.Errorf("bucket cannot be used with src '%s'", s.src)
+		}
+		if s.archive || s.checksum != "" && s.checksum != checksumNone {
+			return fmt.Errorf("archive and checksum can only be used with S3 sources")
+		}
 	}
 	if s.dst == "" {
 		return fmt.Errorf("dst is required")
 	}
+	if s.archive && s.decompress != "" {
+		return fmt.Errorf("decompress cannot be used with archive")
+	}
+	if isImageDestination(s.dst) {
+		if _, err := parseImageDestination(s.dst); err != nil {
+			return err
+		}
+		if s.archive || s.marker != "" || s.decompress != "" {
+			return fmt.Errorf("archive, marker and decompress cannot be used with an image destination")
+		}
+	}
+	if isS3Destination(s.dst) {
+		if bucket, _ := parseS3URL(s.dst); bucket == "" {
+			return fmt.Errorf("dst '%s' has no bucket", s.dst)
+		}
+		if s.archive || s.marker != "" || s.decompress != "" {
+			return fmt.Errorf("archive, marker and decompress cannot be used with an S3 destination")
+		}
+	} else if s.dstRegion != "" {
+		return fmt.Errorf("dst-region can only be used with an S3 destination")
+	}
+	if s.onRelease != "" && (s.archive || isImageDestination(s.dst) || isS3Destination(s.dst)) {
+		return fmt.Errorf("on-release can only be used with a destination directory")
+	}
 
 	v.specs = append(v.specs, &s)
 
 	return nil
 }
 
-type imageTagValue []string
+type registryAuthSpec struct {
+	registry     string
+	usernameFile string
+	passwordFile string
+	tokenFile    string
+	helper       string
+	provider     string
+}
+
+func (s *registryAuthSpec) fromCSV(str string) error {
+	r := csv.NewReader(strings.NewReader(str))
+	fields, err := r.Read()
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid field '%s' must be a key=value pair", field)
+		}
+
+		key, value := parts[0], parts[1]
+		switch key {
+		case "registry":
+			s.registry = value
+		case "username-file":
+			s.usernameFile = value
+		case "password-file":
+			s.passwordFile = value
+		case "token-file":
+			s.tokenFile = value
+		case "helper":
+			s.helper = value
+		case "provider":
+			if value != registryAuthProviderGCP && value != registryAuthProviderAzure {
+				return fmt.Errorf("unknown provider '%s'", value)
+			}
+			s.provider = value
+		default:
+			return fmt.Errorf("unexpected key '%s' in '%s'", key, field)
+		}
+	}
+
+	return nil
+}
+
+type registryAuthValue struct {
+	specs []*registryAuthSpec
+}
+
+// String implements flag.Value
+func (v *registryAuthValue) String() string {
+	registries := make([]string, 0, len(v.specs))
+	for _, s := range v.specs {
+		registries = append(registries, s.registry)
+	}
+	return strings.Join(registries, ",")
+}
+
+// Set implements flag.Value
+func (v *registryAuthValue) Set(value string) error {
+	var s registryAuthSpec
+	if err := s.fromCSV(value); err != nil {
+		return err
+	}
+
+	if s.registry == "" {
+		return fmt.Errorf("registry is required")
+	}
+	// The registries are looked up by their names in the image references,
+	// such as index.docker.io for docker.io.
+	registry, err := name.NewRegistry(strings.ToLower(s.registry), name.WeakValidation)
+	if err != nil {
+		return err
+	}
+	s.registry = registry.Name()
+
+	var sources int
+	if s.usernameFile != "" || s.passwordFile != "" {
+		if s.usernameFile == "" || s.passwordFile == "" {
+			return fmt.Errorf("username-file and password-file must be specified together")
+		}
+		sources++
+	}
+	for _, source := range []string{s.tokenFile, s.helper, s.provider} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("exactly one of username-file and password-file, token-file, helper or provider is required")
+	}
+
+	v.specs = append(v.specs, &s)
+
+	return nil
+}
+
+type stringSliceValue []string
 
 // String implements flag.Value
-func (v *imageTagValue) String() string {
+func (v *stringSliceValue) String() string {
 	return strings.Join(*v, ",")
 }
 
 // Set implements flag.Value
-func (v *imageTagValue) Set(value string) error {
+func (v *stringSliceValue) Set(value string) error {
 	*v = append(*v, value)
 	return nil
 }
 
+// version is the version of s3-sync, which is set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
 var (
-	oneshot     bool
-	stopTimeout time.Duration
-	syncFlag    syncValue
-	tags        imageTagValue
+	baseImage            string
+	buildDebounce        time.Duration
+	buildMaxDelay        time.Duration
+	imageCmd             stringSliceValue
+	imageEntrypoint      stringSliceValue
+	imageFiles           stringSliceValue
+	imageLabels          stringSliceValue
+	imageOutputFlag      string
+	imagePlatforms       stringSliceValue
+	imageProvenance      bool
+	imageRoot            string
+	imageSigningKey      string
+	imageSpecialFiles    string
+	imageTagLatest       stringSliceValue
+	imageTagRetention    int
+	maxBandwidth         int64
+	maxRequestsPerSecond float64
+	oneshot              bool
+	platformBinaries     stringSliceValue
+	registryAuth         registryAuthValue
+	reproducible         bool
+	stopTimeout          time.Duration
+	syncFlag             syncValue
+	tags                 stringSliceValue
 )
 
 func init() {
-	flag.Var(&tags, "image-tag", "Tag of a container image to build and push to a registry after sync.")
+	flag.StringVar(&baseImage, "base-image", "", "Base image of the container image to build. By default, the image is built from scratch with the running s3-sync binary, which is added to the base image too unless -image-entrypoint is specified.")
+	flag.DurationVar(&buildDebounce, "build-debounce", 0, "Time to wait for more syncs to finish before building the container image, which is restarted by every sync with changes.")
+	flag.DurationVar(&buildMaxDelay, "build-max-delay", 0, "Maximum time to delay building the container image by -build-debounce after the first sync with changes.")
+	flag.Var(&imageCmd, "image-cmd", "Argument of the command of the container image to build, in place of the --sync flags.")
+	flag.Var(&imageEntrypoint, "image-entrypoint", "Argument of the entrypoint of the container image to build. (default /s3-sync)")
+	flag.Var(&imageFiles, "image-file", "File to add to the container image to build, in the form of src[:dst].")
+	flag.Var(&imageLabels, "image-label", "Label of the container image to build, in the form of key=value. It is also added to the manifest as an annotation.")
+	flag.StringVar(&imageOutputFlag, "image-output", imageOutputRegistry, "Where to write the container image to: registry, oci:/path/to/layout or docker-archive:/path/to/archive.tar.")
+	flag.Var(&imagePlatforms, "image-platform", "Platform of the container image to build, in the form of os/arch[/variant]. An image index is built if specified.")
+	flag.BoolVar(&imageProvenance, "image-provenance", false, "Push an in-toto provenance attestation of the container image alongside it, tagged sha256-<digest>.att.")
+	flag.StringVar(&imageRoot, "image-root", "/", "Directory of the container image to build under which the destination directories are added, unless their sync specs have an image-path. The directories in the image must not be the same or nested in each other.")
+	flag.StringVar(&imageSigningKey, "image-signing-key", "", "Path to the unencrypted PEM file of the ECDSA P-256 private key to sign the container image with. The cosign-compatible signature is pushed alongside it, tagged sha256-<digest>.sig.")
+	flag.StringVar(&imageSpecialFiles, "image-special-files", specialFilesSkip, "What to do with sockets, devices and named pipes in the destination directories when building the container image: skip or error.")
+	flag.Var(&tags, "image-tag", "Tag of a container image to build and push to a registry after sync. The tag can be a text/template expanded on every build with .Time, .Digest, .Spec, .Specs and .ResolvedPrefix, e.g. repo:{{.Time.Format \"20060102-150405\"}}.")
+	flag.Var(&imageTagLatest, "image-tag-latest", "Tag moved to the latest container image in each repository of the tags, e.g. latest.")
+	flag.IntVar(&imageTagRetention, "image-tag-retention", 0, "Number of tags expanded from each tag template to keep in the registry, newest first by the build time formatted in them or by name. Older ones are deleted after a push unless a kept tag points at the same manifest. The templates must format the build time or the digest. (default keep all)")
+	flag.Int64Var(&maxBandwidth, "max-bandwidth", 0, "Maximum bandwidth in bytes per second shared by all syncs.")
+	flag.Float64Var(&maxRequestsPerSecond, "max-requests-per-second", 0, "Maximum number of S3 requests per second shared by all syncs.")
 	flag.BoolVar(&oneshot, "oneshot", false, "Run the sync and exit.")
+	flag.Var(&platformBinaries, "platform-binary", "Path to the s3-sync binary for a platform of the container image to build, in the form of os/arch[/variant]=path.")
+	flag.Var(&registryAuth, "registry-auth", "Credentials of a container registry, in the form of registry=host followed by username-file=path,password-file=path, token-file=path of an OAuth2 refresh token, helper=name or provider=gcp|azure.")
+	flag.BoolVar(&reproducible, "reproducible", false, "Build the container image reproducibly, with the creation time set by SOURCE_DATE_EPOCH, and skip pushing it if the tag already refers to it.")
 	flag.DurationVar(&stopTimeout, "stop-timeout", 10*time.Second, "Timeout in seconds to stop.")
 	flag.Var(&syncFlag, "sync", "Sync directories and S3 prefixes.")
 }
@@ -169,7 +447,31 @@ func main() {
 		os.Exit(1)
 	}
 
-	runner, err := newRunner(syncFlag.specs, tags, oneshot, stopTimeout)
+	limiter := newRateLimiter(nil, maxRequestsPerSecond, maxBandwidth)
+
+	builderOptions := &builderOptions{
+		tags:             tags,
+		baseImage:        baseImage,
+		files:            imageFiles,
+		labels:           imageLabels,
+		entrypoint:       imageEntrypoint,
+		cmd:              imageCmd,
+		reproducible:     reproducible,
+		platforms:        imagePlatforms,
+		platformBinaries: platformBinaries,
+		output:           imageOutputFlag,
+		provenance:       imageProvenance,
+		root:             imageRoot,
+		signingKey:       imageSigningKey,
+		specialFiles:     imageSpecialFiles,
+		latestTags:       imageTagLatest,
+		tagRetention:     imageTagRetention,
+		debounce:         buildDebounce,
+		maxDelay:         buildMaxDelay,
+		registryAuths:    registryAuth.specs,
+	}
+
+	runner, err := newRunner(syncFlag.specs, builderOptions, oneshot, stopTimeout, limiter)
 	if err != nil {
 		log.Fatal(err)
 	}
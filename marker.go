@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type syncMarker struct {
+	Spec           string    `json:"spec"`
+	Bucket         string    `json:"bucket"`
+	Prefix         string    `json:"prefix"`
+	ResolvedBucket string    `json:"resolvedBucket,omitempty"`
+	ResolvedPrefix string    `json:"resolvedPrefix"`
+	Objects        int       `json:"objects"`
+	Bytes          int64     `json:"bytes"`
+	Digest         string    `json:"digest"`
+	Time           time.Time `json:"time"`
+	// PreviousResolvedPrefix and ReleaseTime record the last switch of the
+	// resolved prefix.
+	PreviousResolvedPrefix string     `json:"previousResolvedPrefix,omitempty"`
+	ReleaseTime            *time.Time `json:"releaseTime,omitempty"`
+}
+
+// syncResult describes the content synced by the last successful sync.
+type syncResult struct {
+	// resolvedBucket is the bucket of the resolved prefix, which is empty
+	// for the sources other than S3.
+	resolvedBucket string
+	resolvedPrefix string
+	objects        int
+	bytes          int64
+	digest         string
+	// previousResolvedPrefix is the resolved prefix before the last release
+	// switch at the release time.
+	previousResolvedPrefix string
+	releaseTime            time.Time
+}
+
+func newSyncResult(resolvedBucket, resolvedPrefix string, objects []*object) *syncResult {
+	result := &syncResult{
+		resolvedBucket: resolvedBucket,
+		resolvedPrefix: resolvedPrefix,
+		objects:        len(objects),
+		digest:         objectsDigest(objects),
+	}
+	for _, o := range objects {
+		result.bytes += o.size
+	}
+	return result
+}
+
+func (r *syncResult) equal(o *syncResult) bool {
+	return r.resolvedBucket == o.resolvedBucket &&
+		r.resolvedPrefix == o.resolvedPrefix &&
+		r.objects == o.objects &&
+		r.bytes == o.bytes &&
+		r.digest == o.digest &&
+		r.previousResolvedPrefix == o.previousResolvedPrefix &&
+		r.releaseTime.Equal(o.releaseTime)
+}
+
+func (s *syncer) markerPath() string {
+	if s.marker == "" {
+		return ""
+	}
+	if filepath.IsAbs(s.marker) {
+		return filepath.Clean(s.marker)
+	}
+	return filepath.Join(s.dst, s.marker)
+}
+
+// updateMarker writes the marker of the result unless the marker of the last
+// result is unchanged, so that the syncs that change nothing leave the
+// destination directory as it is.
+func (s *syncer) updateMarker(last, result *syncResult) error {
+	if s.marker == "" {
+		return nil
+	}
+	if last != nil && last.equal(result) {
+		if _, err := os.Stat(s.markerPath()); err == nil {
+			return nil
+		}
+	}
+	return s.writeMarker(s.markerPath(), result)
+}
+
+// writeMarker writes the marker of the result to the path, which is the marker
+// path or its counterpart in a staging directory.
+func (s *syncer) writeMarker(path string, result *syncResult) error {
+	marker := syncMarker{
+		Bucket:                 s.bucket,
+		Prefix:                 s.prefix,
+		ResolvedBucket:         result.resolvedBucket,
+		ResolvedPrefix:         result.resolvedPrefix,
+		Objects:                result.objects,
+		Bytes:                  result.bytes,
+		Digest:                 result.digest,
+		Time:                   time.Now().UTC(),
+		PreviousResolvedPrefix: result.previousResolvedPrefix,
+	}
+	if !result.releaseTime.IsZero() {
+		marker.ReleaseTime = &result.releaseTime
+	}
+	if s.spec != nil {
+		spec, err := s.spec.toCSV()
+		if err != nil {
+			return err
+		}
+		marker.Spec = spec
+	}
+
+	data, err := json.MarshalIndent(&marker, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Writing marker %s...\n", path)
+
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// objectsDigest returns a digest of the keys, sizes, ETags and link targets
+// of the objects, which changes whenever the synced content changes.
+func objectsDigest(objects []*object) string {
+	h := sha256.New()
+	for _, o := range objects {
+		fmt.Fprintf(h, "%s\t%d\t%s\t%s\n", o.compareKey, o.size, o.etag, o.link)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Chmod(0644); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+)
+
+// labelPrefix is the prefix of the labels and the annotations describing the
+// content synced into the image.
+const labelPrefix = "io.github.kaorimatz.s3-sync."
+
+// imageCreatedAnnotation is the pre-defined OCI annotation of the creation
+// time of an image.
+const imageCreatedAnnotation = "org.opencontainers.image.created"
+
+func parseLabels(values []string) (map[string]string, error) {
+	labels := make(map[string]string, len(values))
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid image label '%s' must be a key=value pair", v)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// imageLabels returns the labels of the image: the version of s3-sync, the
+// source and the synced content of each sync spec, and the user labels, which
+// take precedence.
+func (b *builder) imageLabels(results []*syncResult) map[string]string {
+	labels := map[string]string{labelPrefix + "version": version}
+
+	for i, s := range b.specs {
+		prefix := fmt.Sprintf("%ssync.%d.", labelPrefix, i)
+		if s.src != nil {
+			labels[prefix+"src"] = s.src.String()
+		} else {
+			labels[prefix+"bucket"] = s.bucket
+		}
+		labels[prefix+"prefix"] = s.prefix
+		labels[prefix+"dst"] = s.dst
+		if i < len(b.paths) {
+			labels[prefix+"image-path"] = b.paths[i].dst
+		}
+
+		if i >= len(results) || results[i] == nil {
+			continue
+		}
+		labels[prefix+"resolved-prefix"] = results[i].resolvedPrefix
+		labels[prefix+"objects"] = strconv.Itoa(results[i].objects)
+		labels[prefix+"bytes"] = strconv.FormatInt(results[i].bytes, 10)
+		labels[prefix+"digest"] = results[i].digest
+	}
+
+	for k, v := range b.labels {
+		labels[k] = v
+	}
+
+	return labels
+}
+
+// imageAnnotations returns the annotations of the manifest, which are the
+// labels and the creation time of the image.
+func imageAnnotations(labels map[string]string, created time.Time) map[string]string {
+	annotations := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		annotations[k] = v
+	}
+	annotations[imageCreatedAnnotation] = created.UTC().Format(time.RFC3339)
+	return annotations
+}
+
+// annotatedImage is an image whose manifest has the annotations.
+type annotatedImage struct {
+	v1.Image
+	annotations map[string]string
+}
+
+func annotateImage(image v1.Image, annotations map[string]string) v1.Image {
+	return &annotatedImage{Image: image, annotations: annotations}
+}
+
+// Manifest implements v1.Image
+func (i *annotatedImage) Manifest() (*v1.Manifest, error) {
+	manifest, err := i.Image.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	manifest = manifest.DeepCopy()
+
+	if manifest.Annotations == nil {
+		manifest.Annotations = make(map[string]string, len(i.annotations))
+	}
+	for k, v := range i.annotations {
+		manifest.Annotations[k] = v
+	}
+
+	return manifest, nil
+}
+
+// RawManifest implements v1.Image
+func (i *annotatedImage) RawManifest() ([]byte, error) {
+	manifest, err := i.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(manifest)
+}
+
+// Digest implements v1.Image
+func (i *annotatedImage) Digest() (v1.Hash, error) {
+	return partial.Digest(i)
+}
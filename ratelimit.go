@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// tokenBucket is a token bucket that hands out tokens in the order they are
+// requested, so that concurrent users of a bucket share its rate fairly.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// now is time.Now, replaced in the tests.
+	now func() time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := math.Max(rate, 1)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now(), now: time.Now}
+}
+
+// reserve takes n tokens from the bucket and returns how long the caller has
+// to wait until they are available.
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) wait(ctx context.Context, n float64) error {
+	delay := b.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimiter limits the request rate and the bandwidth of S3 operations.
+// The buckets of the parent limiter are shared with the child limiters, so
+// that a global limit applies to all the syncers together.
+type rateLimiter struct {
+	requests  []*tokenBucket
+	bandwidth []*tokenBucket
+}
+
+func newRateLimiter(parent *rateLimiter, maxRequestsPerSecond float64, maxBandwidth int64) *rateLimiter {
+	l := &rateLimiter{}
+	if parent != nil {
+		l.requests = append(l.requests, parent.requests...)
+		l.bandwidth = append(l.bandwidth, parent.bandwidth...)
+	}
+	if maxRequestsPerSecond > 0 {
+		l.requests = append(l.requests, newTokenBucket(maxRequestsPerSecond))
+	}
+	if maxBandwidth > 0 {
+		l.bandwidth = append(l.bandwidth, newTokenBucket(float64(maxBandwidth)))
+	}
+	if len(l.requests) == 0 && len(l.bandwidth) == 0 {
+		return nil
+	}
+	return l
+}
+
+func (l *rateLimiter) waitRequest(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	for _, b := range l.requests {
+		if err := b.wait(ctx, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *rateLimiter) waitBytes(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	for _, b := range l.bandwidth {
+		if err := b.wait(ctx, float64(n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestOptions returns the options that make every attempt of an AWS API
+// request wait for the request rate limit.
+func (l *rateLimiter) requestOptions() []request.Option {
+	if l == nil || len(l.requests) == 0 {
+		return nil
+	}
+	return []request.Option{func(r *request.Request) {
+		r.Handlers.Sign.PushFront(func(r *request.Request) {
+			if err := l.waitRequest(r.Context()); err != nil {
+				r.Error = err
+			}
+		})
+	}}
+}
+
+func (l *rateLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil || len(l.bandwidth) == 0 {
+		return r
+	}
+	return &limitedReader{ctx: ctx, limiter: l, r: r}
+}
+
+func (l *rateLimiter) writerAt(ctx context.Context, w io.WriterAt) io.WriterAt {
+	if l == nil || len(l.bandwidth) == 0 {
+		return w
+	}
+	return &limitedWriterAt{ctx: ctx, limiter: l, w: w}
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	limiter *rateLimiter
+	r       io.Reader
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if e := r.limiter.waitBytes(r.ctx, n); e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
+
+type limitedWriterAt struct {
+	ctx     context.Context
+	limiter *rateLimiter
+	w       io.WriterAt
+}
+
+func (w *limitedWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if err := w.limiter.waitBytes(w.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return w.w.WriteAt(p, off)
+}
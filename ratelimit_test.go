@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/robfig/cron"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	b := newTokenBucket(10)
+
+	if delay := b.reserve(10); delay != 0 {
+		t.Errorf("reserve(10): got %s, want 0s", delay)
+	}
+
+	delay := b.reserve(5)
+	if delay < 400*time.Millisecond || delay > 500*time.Millisecond {
+		t.Errorf("reserve(5): got %s, want about 500ms", delay)
+	}
+
+	delay = b.reserve(5)
+	if delay < 900*time.Millisecond || delay > time.Second {
+		t.Errorf("reserve(5): got %s, want about 1s", delay)
+	}
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	if l := newRateLimiter(nil, 0, 0); l != nil {
+		t.Errorf("newRateLimiter: got %v, want nil", l)
+	}
+
+	parent := newRateLimiter(nil, 10, 0)
+	l := newRateLimiter(parent, 0, 100)
+	if len(l.requests) != 1 || l.requests[0] != parent.requests[0] {
+		t.Errorf("requests: got %v, want the bucket of the parent", l.requests)
+	}
+	if len(l.bandwidth) != 1 {
+		t.Errorf("bandwidth: got %d buckets, want 1", len(l.bandwidth))
+	}
+}
+
+// testAWSClientFactory returns the S3 clients of the regions.
+type testAWSClientFactory struct {
+	s3Apis map[string]s3iface.S3API
+}
+
+func (f *testAWSClientFactory) newECR(region string) ecriface.ECRAPI {
+	return nil
+}
+
+func (f *testAWSClientFactory) newS3(region string) s3iface.S3API {
+	return f.s3Apis[region]
+}
+
+// freezeRateLimiter stops refilling the buckets of the limiter, so that the
+// tokens taken from them count the requests and the bytes.
+func freezeRateLimiter(l *rateLimiter) {
+	for _, b := range append(append([]*tokenBucket(nil), l.requests...), l.bandwidth...) {
+		now := b.last
+		b.now = func() time.Time { return now }
+	}
+}
+
+func (b *tokenBucket) taken() float64 {
+	return b.burst - b.tokens
+}
+
+func TestSyncRateLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ratelimit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The rates are high enough for nothing to wait.
+	const rate = 1e9
+	parent := newRateLimiter(nil, rate, rate)
+	freezeRateLimiter(parent)
+
+	modTime := time.Now()
+	factory := &testAWSClientFactory{s3Apis: map[string]s3iface.S3API{
+		"region1": &s3Api{objects: []*testObject{
+			{content: "a", key: "prefix/key1", lastModified: modTime},
+			{content: "bb", key: "prefix/key2", lastModified: modTime},
+		}},
+		"region2": &s3Api{objects: []*testObject{
+			{content: "ccc", key: "prefix/key3", lastModified: modTime},
+		}},
+	}}
+	specs := []*syncSpec{
+		{bucket: "bucket", prefix: "prefix", region: "region1", dst: filepath.Join(dir, "dst1"), checksum: checksumAuto, maxRequestsPerSecond: rate, maxBandwidth: rate, schedule: "@every 1h"},
+		{bucket: "bucket", prefix: "prefix", region: "region2", dst: filepath.Join(dir, "dst2"), checksum: checksumAuto, maxRequestsPerSecond: rate, maxBandwidth: rate, schedule: "@every 1h"},
+	}
+
+	// The syncers are created by the runner and synced by the test.
+	r := &cronRunner{
+		awsClientFactory: factory,
+		builderOptions:   &builderOptions{},
+		c:                cron.New(),
+		limiter:          parent,
+		specs:            specs,
+	}
+	ctx := context.Background()
+	if err := r.startSyncers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer r.c.Stop()
+
+	for i := range r.specs {
+		s := r.syncers[i].(*syncer)
+		freezeRateLimiter(s.limiter)
+		// The specs share the buckets of the parent limiter.
+		if len(s.limiter.requests) != 2 || s.limiter.requests[0] != parent.requests[0] {
+			t.Errorf("spec %d, requests: got %v, want the bucket of the parent and its own", i, s.limiter.requests)
+		}
+		if len(s.limiter.bandwidth) != 2 || s.limiter.bandwidth[0] != parent.bandwidth[0] {
+			t.Errorf("spec %d, bandwidth: got %v, want the bucket of the parent and its own", i, s.limiter.bandwidth)
+		}
+	}
+
+	tests := []struct {
+		requests float64
+		bytes    float64
+	}{
+		// A ListObjectsV2 page and a GetObject per object, a GetObject for
+		// the link object and a HeadObject for the checksums.
+		{requests: 2 + 2 + 1 + 1, bytes: 1 + 2 + 1},
+		{requests: 1 + 1 + 1 + 1, bytes: 3 + 3},
+	}
+	for i, test := range tests {
+		s := r.syncers[i].(*syncer)
+		if _, err := s.sync(ctx); err != nil {
+			t.Fatalf("spec %d: %v", i, err)
+		}
+		api := factory.s3Apis[specs[i].region]
+		link := api.(*s3Api).objects[0].key
+		if _, _, err := readLinkObject(ctx, api, s.limiter, "bucket", link, "", ""); err != nil {
+			t.Fatalf("spec %d: %v", i, err)
+		}
+		if _, err := s.headObjectChecksums(ctx, link); err != nil {
+			t.Fatalf("spec %d: %v", i, err)
+		}
+
+		if got := s.limiter.requests[1].taken(); got != test.requests {
+			t.Errorf("spec %d, requests: got %g, want %g", i, got, test.requests)
+		}
+		if got := s.limiter.bandwidth[1].taken(); got != test.bytes {
+			t.Errorf("spec %d, bytes: got %g, want %g", i, got, test.bytes)
+		}
+	}
+
+	if got, want := parent.requests[0].taken(), tests[0].requests+tests[1].requests; got != want {
+		t.Errorf("parent, requests: got %g, want %g", got, want)
+	}
+	if got, want := parent.bandwidth[0].taken(), tests[0].bytes+tests[1].bytes; got != want {
+		t.Errorf("parent, bytes: got %g, want %g", got, want)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// testRegistry is an in-process registry implementing the parts of the
+// Docker Registry HTTP API V2 used by go-containerregistry.
+type testRegistry struct {
+	*httptest.Server
+	blobs     map[string][]byte
+	manifests map[string]map[string]testManifest
+	mutex     sync.Mutex
+	uploads   map[string][]byte
+}
+
+type testManifest struct {
+	data      []byte
+	mediaType string
+}
+
+func newTestRegistry() *testRegistry {
+	r := &testRegistry{
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string]map[string]testManifest),
+		uploads:   make(map[string][]byte),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	return r
+}
+
+// host returns the host of the registry to use in image references.
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(r.URL, "http://")
+}
+
+func (r *testRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	// The body is read before the registry is locked, as a streamed upload
+	// may be written while blobs are read from the registry.
+	body, _ := ioutil.ReadAll(req.Body)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	path := req.URL.Path
+	switch {
+	case path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case strings.HasPrefix(path, "/uploads/"):
+		r.serveUpload(w, req, strings.TrimPrefix(path, "/uploads/"), body)
+	case strings.HasSuffix(path, "/blobs/uploads/"):
+		id := fmt.Sprintf("%d", len(r.uploads))
+		r.uploads[id] = nil
+		w.Header().Set("Location", "/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case strings.Contains(path, "/blobs/"):
+		data, ok := r.blobs[path[strings.LastIndex(path, "/")+1:]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		w.Write(data)
+	case strings.HasSuffix(path, "/tags/list"):
+		r.serveTags(w, strings.TrimSuffix(strings.TrimPrefix(path, "/v2/"), "/tags/list"))
+	case strings.Contains(path, "/manifests/"):
+		i := strings.LastIndex(path, "/manifests/")
+		r.serveManifest(w, req, strings.TrimPrefix(path[:i], "/v2/"), path[i+len("/manifests/"):], body)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *testRegistry) serveUpload(w http.ResponseWriter, req *http.Request, id string, body []byte) {
+	r.uploads[id] = append(r.uploads[id], body...)
+
+	switch req.Method {
+	case http.MethodPatch:
+		w.Header().Set("Location", req.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		r.blobs[req.URL.Query().Get("digest")] = r.uploads[id]
+		delete(r.uploads, id)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (r *testRegistry) serveManifest(w http.ResponseWriter, req *http.Request, repository, reference string, body []byte) {
+	manifests := r.manifests[repository]
+
+	switch req.Method {
+	case http.MethodPut:
+		sum := sha256.Sum256(body)
+		digest := "sha256:" + hex.EncodeToString(sum[:])
+		if manifests == nil {
+			manifests = make(map[string]testManifest)
+			r.manifests[repository] = manifests
+		}
+		m := testManifest{data: body, mediaType: req.Header.Get("Content-Type")}
+		manifests[reference] = m
+		manifests[digest] = m
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if _, ok := manifests[reference]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(manifests, reference)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		m, ok := manifests[reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+			return
+		}
+		sum := sha256.Sum256(m.data)
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(m.data)))
+		w.Header().Set("Docker-Content-Digest", "sha256:"+hex.EncodeToString(sum[:]))
+		if req.Method == http.MethodGet {
+			w.Write(m.data)
+		}
+	}
+}
+
+func (r *testRegistry) serveTags(w http.ResponseWriter, repository string) {
+	tags := []string{}
+	for reference := range r.manifests[repository] {
+		if !strings.HasPrefix(reference, "sha256:") {
+			tags = append(tags, reference)
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": tags})
+}
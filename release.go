@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// location returns the URL of the resolved prefix of the result.
+func (r *syncResult) location(src *url.URL) string {
+	return sourceLocation(src, r.resolvedBucket, r.resolvedPrefix)
+}
+
+// previousResult returns the result of the last successful sync, or the one
+// recorded in the marker by the previous run, or nil if neither is known.
+func (s *syncer) previousResult() *syncResult {
+	if s.result != nil || s.marker == "" {
+		return s.result
+	}
+
+	data, err := ioutil.ReadFile(s.markerPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading marker %s: %v\n", s.markerPath(), err)
+		}
+		return nil
+	}
+	var marker syncMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		log.Printf("Error reading marker %s: %v\n", s.markerPath(), err)
+		return nil
+	}
+
+	result := &syncResult{
+		resolvedBucket:         marker.ResolvedBucket,
+		resolvedPrefix:         marker.ResolvedPrefix,
+		objects:                marker.Objects,
+		bytes:                  marker.Bytes,
+		digest:                 marker.Digest,
+		previousResolvedPrefix: marker.PreviousResolvedPrefix,
+	}
+	if marker.ReleaseTime != nil {
+		result.releaseTime = *marker.ReleaseTime
+	}
+	return result
+}
+
+// switchRelease materialises the objects under the new resolved prefix and
+// the marker in a staging directory next to the destination directory, and
+// exchanges it with the destination directory at once, so that the readers
+// never see a mix of the previous and the new releases.
+func (s *syncer) switchRelease(ctx context.Context, previous, result *syncResult, objects *objectIterator) (bool, error) {
+	log.Printf("Switching %s from %s to %s...\n", s.dst, previous.location(s.src), result.location(s.src))
+
+	dst := filepath.Clean(s.dst)
+	staging, err := ioutil.TempDir(filepath.Dir(dst), "."+filepath.Base(dst)+".release")
+	if err != nil {
+		return false, err
+	}
+	// The staging directory has the previous release once exchanged.
+	defer os.RemoveAll(staging)
+
+	// The files the releases have in common are hard-linked instead of
+	// downloaded again.
+	if err := linkTree(dst, staging); err != nil {
+		return false, err
+	}
+
+	marker := s.markerPath()
+	if rel, err := filepath.Rel(dst, marker); marker != "" && err == nil && !strings.HasPrefix(rel, "..") {
+		marker = filepath.Join(staging, rel)
+	}
+	d := newLocalDestination(staging, marker, s.decompress != "")
+	if _, err := s.updateDestination(ctx, d, objects); err != nil {
+		return false, err
+	}
+
+	result.previousResolvedPrefix = previous.resolvedPrefix
+	result.releaseTime = time.Now().UTC()
+	// The marker in the destination directory is switched along with the
+	// release, and the one outside of it is written once it is switched.
+	staged := marker != s.markerPath()
+	if staged {
+		if err := s.writeMarker(marker, result); err != nil {
+			return false, err
+		}
+	}
+
+	if err := exchangeDirs(staging, dst); err != nil {
+		return false, err
+	}
+	log.Printf("Switched %s to %s\n", s.dst, result.location(s.src))
+
+	if s.marker != "" && !staged {
+		if err := s.writeMarker(s.markerPath(), result); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// canSwitchRelease reports whether the destination directory can be exchanged
+// with a staging directory next to it, which is not the case for a mount
+// point, as the staging directory would be on another file system.
+func (s *syncer) canSwitchRelease() (bool, error) {
+	dst := filepath.Clean(s.dst)
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		return false, err
+	}
+	mountPoint, err := isMountPoint(dst)
+	return !mountPoint, err
+}
+
+// runReleaseHook runs the on-release command of the sync spec with the
+// previous and the new resolved prefixes in the environment. The release is
+// not rolled back if the command fails.
+func (s *syncer) runReleaseHook(ctx context.Context, result *syncResult) {
+	if s.onRelease == "" {
+		return
+	}
+
+	log.Printf("Running %s...\n", s.onRelease)
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", s.onRelease)
+	cmd.Env = append(os.Environ(),
+		"S3_SYNC_DST="+s.dst,
+		"S3_SYNC_PREVIOUS_RESOLVED_PREFIX="+result.previousResolvedPrefix,
+		"S3_SYNC_RESOLVED_PREFIX="+result.resolvedPrefix,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("Error running %s: %v: %s\n", s.onRelease, err, output)
+	}
+}
+
+// renameDirs exchanges the directories by renaming a to a temporary name, b to
+// a and the temporary name to b, which is not atomic.
+func renameDirs(a, b string) error {
+	tmp := tempFileName(a)
+	if err := os.Rename(a, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(b, a); err != nil {
+		os.Rename(tmp, a)
+		return err
+	}
+	return os.Rename(tmp, b)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSwitchRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "release_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	modTime := time.Now().Add(-time.Hour)
+	api := &bucketApi{buckets: map[string]map[string]*testObject{
+		"bucket": {
+			"current":      {content: "releases/1"},
+			"releases/1/a": {content: "a1", lastModified: modTime},
+			"releases/1/b": {content: "b", lastModified: modTime},
+			"releases/2/a": {content: "a2", lastModified: modTime.Add(time.Minute)},
+			"releases/2/c": {content: "c", lastModified: modTime},
+		},
+	}}
+	dst := filepath.Join(dir, "dst")
+	env := filepath.Join(dir, "env")
+	newTestSyncer := func() *syncer {
+		return &syncer{
+			bucket:              "bucket",
+			prefix:              "current",
+			dst:                 dst,
+			marker:              ".s3-sync.json",
+			linkObjectKeyRegexp: regexp.MustCompile(`^current$`),
+			onRelease:           `echo "$S3_SYNC_PREVIOUS_RESOLVED_PREFIX $S3_SYNC_RESOLVED_PREFIX" > ` + env,
+			limiter:             newRateLimiter(nil, 0, 0),
+			s3Api:               api,
+		}
+	}
+
+	if _, err := newTestSyncer().sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(env); !os.IsNotExist(err) {
+		t.Errorf("hook: got run without a release switch")
+	}
+
+	// The previous release is read from the marker by a new syncer.
+	api.buckets["bucket"]["current"].content = "releases/2"
+	changed, err := newTestSyncer().sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("release switch: got unchanged")
+	}
+
+	for name, want := range map[string]string{"a": "a2", "c": "c"} {
+		if got, err := ioutil.ReadFile(filepath.Join(dst, name)); err != nil {
+			t.Error(err)
+		} else if string(got) != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "b")); !os.IsNotExist(err) {
+		t.Errorf("b: got %v, want removed", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dst, ".s3-sync.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var marker syncMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		t.Fatal(err)
+	}
+	if marker.ResolvedPrefix != "releases/2/" || marker.PreviousResolvedPrefix != "releases/1/" || marker.ReleaseTime == nil {
+		t.Errorf("marker: got resolvedPrefix %q, previousResolvedPrefix %q and releaseTime %v", marker.ResolvedPrefix, marker.PreviousResolvedPrefix, marker.ReleaseTime)
+	}
+
+	if got, err := ioutil.ReadFile(env); err != nil {
+		t.Error(err)
+	} else if want := "releases/1/ releases/2/\n"; string(got) != want {
+		t.Errorf("hook: got %q, want %q", got, want)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, ".dst.release*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) > 0 {
+		t.Errorf("staging directories: got %v, want none", files)
+	}
+}
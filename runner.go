@@ -17,7 +17,7 @@ type runner interface {
 	run(ctx context.Context) error
 }
 
-func newRunner(specs []*syncSpec, tags []string, oneshot bool, stopTimeout time.Duration) (runner, error) {
+func newRunner(specs []*syncSpec, builderOptions *builderOptions, oneshot bool, stopTimeout time.Duration, limiter *rateLimiter) (runner, error) {
 	awsClientFactory, err := newDefaultAWSClientFactory()
 	if err != nil {
 		return nil, err
@@ -26,62 +26,68 @@ func newRunner(specs []*syncSpec, tags []string, oneshot bool, stopTimeout time.
 	if oneshot {
 		return &oneshotRunner{
 			awsClientFactory: awsClientFactory,
+			builderOptions:   builderOptions,
+			limiter:          limiter,
 			specs:            specs,
-			tags:             tags,
 		}, nil
 	} else {
 		return &cronRunner{
 			awsClientFactory: awsClientFactory,
+			builderOptions:   builderOptions,
 			c:                cron.New(),
+			limiter:          limiter,
 			specs:            specs,
 			stopTimeout:      stopTimeout,
-			tags:             tags,
 		}, nil
 	}
 }
 
 type oneshotRunner struct {
 	awsClientFactory awsClientFactory
+	builderOptions   *builderOptions
+	limiter          *rateLimiter
 	specs            []*syncSpec
-	tags             []string
 }
 
 func (r *oneshotRunner) run(ctx context.Context) error {
-	if err := r.sync(ctx); err != nil {
+	syncers, err := r.sync(ctx)
+	if err != nil {
 		return err
 	}
 
-	if err := r.build(ctx); err != nil {
+	if err := r.build(ctx, syncers); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (r *oneshotRunner) sync(ctx context.Context) error {
+func (r *oneshotRunner) sync(ctx context.Context) ([]snapshotter, error) {
 	log.Println("Starting syncing...")
+	syncers := make([]snapshotter, 0, len(r.specs))
 	for _, s := range r.specs {
-		syncer := newSyncer(s.region, s.bucket, s.prefix, s.dst, s.linkObjectKeyRegexp, r.awsClientFactory)
+		syncer := newSyncer(s, r.limiter, r.awsClientFactory, r.builderOptions.registryAuths)
 		if _, err := syncer.sync(ctx); err != nil {
-			return fmt.Errorf("error syncing: %v", err)
+			return nil, fmt.Errorf("error syncing: %v", err)
 		}
+		syncers = append(syncers, syncer)
 	}
 	log.Println("Finished syncing")
-	return nil
+	return syncers, nil
 }
 
-func (r *oneshotRunner) build(ctx context.Context) error {
-	if r.tags == nil {
+func (r *oneshotRunner) build(ctx context.Context, syncers []snapshotter) error {
+	if len(r.builderOptions.tags) == 0 {
 		return nil
 	}
 
-	builder, err := newBuilderFromSyncSpecs(r.tags, r.specs, r.awsClientFactory)
+	builder, err := newBuilderFromSyncSpecs(r.builderOptions, r.specs, r.awsClientFactory)
 	if err != nil {
 		return err
 	}
 
 	log.Println("Starting building image...")
-	if err := builder.build(ctx); err != nil {
+	if err := builder.build(ctx, syncers); err != nil {
 		return fmt.Errorf("error building image: %v", err)
 	}
 	log.Println("Finished building image")
@@ -92,16 +98,35 @@ func (r *oneshotRunner) build(ctx context.Context) error {
 type cronRunner struct {
 	awsClientFactory awsClientFactory
 	buildCh          chan struct{}
+	builderOptions   *builderOptions
 	c                *cron.Cron
 	cancelCtx        context.Context
 	cancelFunc       context.CancelFunc
-	mutex            sync.RWMutex
+	limiter          *rateLimiter
 	specs            []*syncSpec
-	tags             []string
+	syncers          []snapshotter
 	stopCtx          context.Context
 	stopFunc         context.CancelFunc
 	stopTimeout      time.Duration
 	wg               sync.WaitGroup
+	// newTimer is time.NewTimer, replaced in the tests.
+	newTimer func(time.Duration) timer
+}
+
+// timer is a timer of coalesceBuilds, which is a *time.Timer except in the
+// tests.
+type timer interface {
+	channel() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type stdTimer struct {
+	*time.Timer
+}
+
+func (t stdTimer) channel() <-chan time.Time {
+	return t.C
 }
 
 func (r *cronRunner) run(ctx context.Context) error {
@@ -126,7 +151,8 @@ func (r *cronRunner) run(ctx context.Context) error {
 func (r *cronRunner) startSyncers(ctx context.Context) error {
 	var syncers []*syncer
 	for _, s := range r.specs {
-		syncer := newSyncer(s.region, s.bucket, s.prefix, s.dst, s.linkObjectKeyRegexp, r.awsClientFactory)
+		syncer := newSyncer(s, r.limiter, r.awsClientFactory, r.builderOptions.registryAuths)
+		r.syncers = append(r.syncers, syncer)
 		if s.schedule == "" || s.onStart {
 			syncers = append(syncers, syncer)
 		}
@@ -150,8 +176,8 @@ func (r *cronRunner) startSyncers(ctx context.Context) error {
 		log.Println("Finished syncing")
 	}
 
-	if changed && r.buildCh != nil {
-		r.buildCh <- struct{}{}
+	if changed {
+		r.triggerBuild()
 	}
 
 	r.c.Start()
@@ -186,9 +212,6 @@ func (r *cronRunner) runSync(syncer *syncer, guardCh chan struct{}) {
 }
 
 func (r *cronRunner) sync(syncer *syncer) {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-
 	log.Println("Starting syncing...")
 	changed, err := syncer.sync(r.cancelCtx)
 	if err != nil {
@@ -197,22 +220,34 @@ func (r *cronRunner) sync(syncer *syncer) {
 	}
 	log.Println("Finished syncing")
 
-	if changed && r.buildCh != nil {
-		r.buildCh <- struct{}{}
+	if changed {
+		r.triggerBuild()
+	}
+}
+
+// triggerBuild requests a build unless one is already pending, in which case
+// the changes are included in the pending build.
+func (r *cronRunner) triggerBuild() {
+	if r.buildCh == nil {
+		return
+	}
+	select {
+	case r.buildCh <- struct{}{}:
+	default:
 	}
 }
 
 func (r *cronRunner) startBuilder() error {
-	if r.tags == nil {
+	if len(r.builderOptions.tags) == 0 {
 		return nil
 	}
 
-	builder, err := newBuilderFromSyncSpecs(r.tags, r.specs, r.awsClientFactory)
+	builder, err := newBuilderFromSyncSpecs(r.builderOptions, r.specs, r.awsClientFactory)
 	if err != nil {
 		return err
 	}
 
-	r.buildCh = make(chan struct{}, len(r.specs))
+	r.buildCh = make(chan struct{}, 1)
 
 	r.wg.Add(1)
 	go func() {
@@ -220,25 +255,81 @@ func (r *cronRunner) startBuilder() error {
 		for {
 			select {
 			case <-r.buildCh:
-				if r.stopCtx.Err() != nil {
-					return
-				}
-				r.build(builder)
 			case <-r.stopCtx.Done():
 				return
 			}
+			if !r.coalesceBuilds() {
+				return
+			}
+			r.build(builder)
 		}
 	}()
 
 	return nil
 }
 
-func (r *cronRunner) build(builder *builder) {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+// coalesceBuilds waits until no build has been triggered for the debounce
+// window, or until the max delay has passed since the first trigger, so that
+// the triggers of syncs finishing close together result in a single build.
+// It returns false if the runner is stopping.
+func (r *cronRunner) coalesceBuilds() bool {
+	if r.builderOptions.debounce > 0 {
+		log.Printf("Waiting %s for more changes before building image...\n", r.builderOptions.debounce)
+
+		debounce := r.timer(r.builderOptions.debounce)
+		defer debounce.Stop()
+		var maxDelay <-chan time.Time
+		if r.builderOptions.maxDelay > 0 {
+			t := r.timer(r.builderOptions.maxDelay)
+			defer t.Stop()
+			maxDelay = t.channel()
+		}
+
+	wait:
+		for {
+			select {
+			case <-r.buildCh:
+				// The debounce window is restarted without the time of
+				// the previous one if it has just ended.
+				if !debounce.Stop() {
+					select {
+					case <-debounce.channel():
+					default:
+					}
+				}
+				debounce.Reset(r.builderOptions.debounce)
+			case <-debounce.channel():
+				break wait
+			case <-maxDelay:
+				break wait
+			case <-r.stopCtx.Done():
+				return false
+			}
+		}
+	}
 
+	// The snapshots taken by the build include the changes of the triggers
+	// received so far.
+	select {
+	case <-r.buildCh:
+	default:
+	}
+
+	return r.stopCtx.Err() == nil
+}
+
+func (r *cronRunner) timer(d time.Duration) timer {
+	if r.newTimer != nil {
+		return r.newTimer(d)
+	}
+	return stdTimer{time.NewTimer(d)}
+}
+
+// build builds the image from snapshots of the destination directories, so
+// that the syncs can keep updating them while the image is built.
+func (r *cronRunner) build(builder *builder) {
 	log.Println("Starting building image...")
-	if err := builder.build(r.cancelCtx); err != nil {
+	if err := builder.build(r.cancelCtx, r.syncers); err != nil {
 		log.Printf("Error building image: %v\n", err)
 		return
 	}
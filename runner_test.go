@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// testTimer is a timer created by coalesceBuilds, fired by the tests.
+type testTimer struct {
+	d      time.Duration
+	c      chan time.Time
+	resets chan time.Duration
+}
+
+func (t *testTimer) channel() <-chan time.Time {
+	return t.c
+}
+
+// Stop reports that the timer has fired and leaves its time in the channel,
+// as a time.Timer stopped right after it fires does.
+func (t *testTimer) Stop() bool {
+	select {
+	case t.c <- time.Now():
+	default:
+	}
+	return false
+}
+
+func (t *testTimer) Reset(d time.Duration) bool {
+	t.resets <- d
+	return false
+}
+
+func TestCronRunnerCoalesceBuilds(t *testing.T) {
+	const debounce, maxDelay = time.Second, 2 * time.Second
+
+	tests := []struct {
+		maxDelay time.Duration
+		// fire is the timer that ends the wait after three triggers.
+		fire time.Duration
+	}{
+		// Every trigger restarts the debounce window.
+		{fire: debounce},
+		// The max delay cuts the wait short.
+		{maxDelay: maxDelay, fire: maxDelay},
+	}
+
+	for _, test := range tests {
+		timers := make(chan *testTimer)
+		r := &cronRunner{
+			buildCh:        make(chan struct{}, 1),
+			builderOptions: &builderOptions{debounce: debounce, maxDelay: test.maxDelay},
+			newTimer: func(d time.Duration) timer {
+				timer := &testTimer{d: d, c: make(chan time.Time, 1), resets: make(chan time.Duration)}
+				timers <- timer
+				return timer
+			},
+		}
+		r.stopCtx, r.stopFunc = context.WithCancel(context.Background())
+
+		done := make(chan bool)
+		go func() { done <- r.coalesceBuilds() }()
+
+		// A single timer is created for the debounce window and the max
+		// delay each.
+		n := 1
+		if test.maxDelay > 0 {
+			n = 2
+		}
+		var last, max *testTimer
+		for i := 0; i < n; i++ {
+			timer := <-timers
+			if timer.d == maxDelay {
+				max = timer
+			} else {
+				last = timer
+			}
+		}
+		if last == nil || last.d != debounce {
+			t.Fatalf("maxDelay=%s: got no timer of %s", test.maxDelay, debounce)
+		}
+
+		// Every trigger resets the debounce timer, which is not ended by
+		// the time left in its channel by the previous window.
+		for i := 0; i < 3; i++ {
+			r.triggerBuild()
+			if d := <-last.resets; d != debounce {
+				t.Fatalf("maxDelay=%s: got a reset to %s, want %s", test.maxDelay, d, debounce)
+			}
+		}
+		select {
+		case <-done:
+			t.Fatalf("maxDelay=%s: got done before the timers fire", test.maxDelay)
+		case timer := <-timers:
+			t.Fatalf("maxDelay=%s: got a new timer of %s", test.maxDelay, timer.d)
+		default:
+		}
+
+		if test.fire == maxDelay {
+			max.c <- time.Now()
+		} else {
+			last.c <- time.Now()
+		}
+		if !<-done {
+			t.Errorf("maxDelay=%s: coalesceBuilds: got false, want true", test.maxDelay)
+		}
+
+		r.stopFunc()
+		go func() { done <- r.coalesceBuilds() }()
+		<-timers
+		if test.maxDelay > 0 {
+			<-timers
+		}
+		if <-done {
+			t.Errorf("maxDelay=%s: coalesceBuilds after stop: got true, want false", test.maxDelay)
+		}
+	}
+}
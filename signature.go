@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	simpleSigningMediaType    = "application/vnd.dev.cosign.simplesigning.v1+json"
+	simpleSigningType         = "cosign container image signature"
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+// simpleSigningPayload is the payload signed for an image, in the simple
+// signing format used by cosign.
+type simpleSigningPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]string `json:"optional"`
+}
+
+// loadSigningKey reads the ECDSA P-256 private key from the unencrypted PEM
+// file, in either the SEC 1 or the PKCS #8 form.
+func loadSigningKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in signing key %s", path)
+	}
+
+	var key *ecdsa.PrivateKey
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if key, ok = k.(*ecdsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("signing key %s is not an ECDSA key", path)
+		}
+	case "ENCRYPTED COSIGN PRIVATE KEY":
+		return nil, fmt.Errorf("encrypted cosign key %s is not supported, export it unencrypted", path)
+	default:
+		return nil, fmt.Errorf("unknown PEM block type '%s' of signing key %s", block.Type, path)
+	}
+
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("signing key %s is not a P-256 key", path)
+	}
+
+	return key, nil
+}
+
+// ecdsaSignature is the ASN.1 structure of an ECDSA signature.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// sign returns the ASN.1 encoded signature of the SHA-256 digest of the data.
+func sign(key *ecdsa.PrivateKey, data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(ecdsaSignature{R: r, S: s})
+}
+
+// pushSignature signs the image or the image index and pushes the signature
+// to each repository of the tags, tagged sha256-<digest>.sig, so that it can
+// be verified with `cosign verify --key`.
+func (b *builder) pushSignature(ctx context.Context, artifact digester, tags []name.Tag) error {
+	digest, err := artifact.Digest()
+	if err != nil {
+		return err
+	}
+
+	for _, repository := range repositories(tags) {
+		image, err := b.signatureImage(repository, digest)
+		if err != nil {
+			return err
+		}
+
+		sigTag, err := artifactTag(repository, digest, "sig")
+		if err != nil {
+			return err
+		}
+
+		if err := b.pushArtifact(ctx, sigTag, image); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *builder) signatureImage(repository name.Repository, digest v1.Hash) (*artifactImage, error) {
+	var payload simpleSigningPayload
+	payload.Critical.Identity.DockerReference = repository.Name()
+	payload.Critical.Image.DockerManifestDigest = digest.String()
+	payload.Critical.Type = simpleSigningType
+
+	data, err := json.Marshal(&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := sign(b.signingKey, data)
+	if err != nil {
+		return nil, err
+	}
+
+	annotations := map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)}
+	return newArtifactImage(data, simpleSigningMediaType, annotations)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestBuilderBuildSignature(t *testing.T) {
+	registry := newTestRegistry()
+	defer registry.Close()
+
+	dir, err := ioutil.TempDir("", "signature_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "cosign.key")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if err := os.Mkdir(dst, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	options := &builderOptions{tags: []string{registry.host() + "/repository:tag"}, signingKey: keyFile}
+	b, err := newBuilder(options, []string{dst}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, l := range b.layers {
+			os.Remove(l.file)
+		}
+	}()
+	b.baseImages[""] = empty.Image
+
+	if err := b.build(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err := name.NewTag(registry.host()+"/repository:tag", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := remote.Get(tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sigTag, err := artifactTag(tag.Context(), desc.Digest, "sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigImage, err := remote.Image(sigTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := sigImage.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := sigImage.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := layers[0].Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if manifest.Layers[0].MediaType != simpleSigningMediaType {
+		t.Errorf("media type: got %s, want %s", manifest.Layers[0].MediaType, simpleSigningMediaType)
+	}
+	sig, err := base64.StdEncoding.DecodeString(manifest.Layers[0].Annotations[cosignSignatureAnnotation])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var es ecdsaSignature
+	if _, err := asn1.Unmarshal(sig, &es); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(payload)
+	if !ecdsa.Verify(&key.PublicKey, digest[:], es.R, es.S) {
+		t.Error("signature is not valid")
+	}
+
+	var p simpleSigningPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Critical.Image.DockerManifestDigest != desc.Digest.String() {
+		t.Errorf("signed digest: got %s, want %s", p.Critical.Image.DockerManifestDigest, desc.Digest)
+	}
+	if p.Critical.Identity.DockerReference != tag.Context().Name() {
+		t.Errorf("signed reference: got %s, want %s", p.Critical.Identity.DockerReference, tag.Context().Name())
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// snapshot is the content of the destination directory of a sync spec at a
+// point in time, and the result of the sync that produced it.
+type snapshot struct {
+	// path is the directory holding the content, which is either a tree of
+	// hard links to the synced files or the destination directory itself.
+	path   string
+	result *syncResult
+	// temporary reports whether path is a copy to remove after use.
+	temporary bool
+}
+
+// snapshotter takes snapshots of a directory.
+type snapshotter interface {
+	snapshot() (*snapshot, error)
+}
+
+// liveDirectory is a directory used as is, for the builds whose directories
+// are not updated concurrently.
+type liveDirectory string
+
+func (d liveDirectory) snapshot() (*snapshot, error) {
+	return &snapshot{path: string(d)}, nil
+}
+
+// snapshot takes a snapshot of the destination directory between syncs. The
+// synced files are never modified in place but replaced by renames, so the
+// hard links keep pointing to the content at the time of the snapshot while
+// the following syncs update the directory.
+func (s *syncer) snapshot() (*snapshot, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	src := filepath.Clean(s.dst)
+	dir, err := snapshotDir(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := linkTree(src, dir); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return &snapshot{path: dir, result: s.result, temporary: true}, nil
+}
+
+// snapshotDirPrefix is the prefix of the names of the snapshot directories,
+// which are skipped when the destination directories are listed, linked and
+// added to the images, in case they are in another destination directory.
+const snapshotDirPrefix = ".s3-sync-snapshot."
+
+// snapshotDir creates a directory on the file system of the destination
+// directory, so that the files can be hard-linked: next to it, or in it if it
+// is a mount point.
+func snapshotDir(dst string) (string, error) {
+	parent := filepath.Dir(dst)
+	if mountPoint, err := isMountPoint(dst); err != nil {
+		return "", err
+	} else if mountPoint {
+		parent = dst
+	}
+	return ioutil.TempDir(parent, snapshotDirPrefix+filepath.Base(dst)+".")
+}
+
+func isSnapshotDir(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), snapshotDirPrefix)
+}
+
+// isMountPoint reports whether the directory is on another file system than
+// its parent directory.
+func isMountPoint(dir string) (bool, error) {
+	same, err := sameFileSystem(dir, filepath.Dir(dir))
+	return !same, err
+}
+
+// sameFileSystem reports whether the files are on the same file system, or
+// true if it is unknown on the platform.
+func sameFileSystem(a, b string) (bool, error) {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+
+	aStat, aOk := aInfo.Sys().(*syscall.Stat_t)
+	bStat, bOk := bInfo.Sys().(*syscall.Stat_t)
+	return !aOk || !bOk || aStat.Dev == bStat.Dev, nil
+}
+
+func (s *snapshot) remove() error {
+	if !s.temporary {
+		return nil
+	}
+	return os.RemoveAll(s.path)
+}
+
+// linkTree recreates the tree at src in dst, hard-linking the regular files
+// or copying them if they cannot be linked, e.g. across file systems.
+func linkTree(src, dst string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		target := dst + strings.TrimPrefix(p, src)
+		mode := info.Mode()
+		switch {
+		case p == src:
+			return os.Chmod(dst, mode.Perm())
+		case mode.IsDir() && isSnapshotDir(p):
+			return filepath.SkipDir
+		case mode.IsDir():
+			return os.Mkdir(target, mode.Perm())
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			return lchtimes(target, info.ModTime())
+		case mode.IsRegular():
+			if err := os.Link(p, target); err == nil {
+				return nil
+			}
+			return copyFile(p, target, info)
+		default:
+			return nil
+		}
+	})
+}
+
+func copyFile(src, dst string, info os.FileInfo) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return lchtimes(dst, info.ModTime())
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSyncerSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "dst")
+	if err := os.MkdirAll(filepath.Join(dst, "dir"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dst, "dir", "key1"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/key1", filepath.Join(dst, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	result := &syncResult{resolvedPrefix: "releases/1/"}
+	s := &syncer{dst: dst, result: result}
+	snapshot, err := s.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.remove()
+
+	if snapshot.result != result {
+		t.Errorf("result: got %+v, want %+v", snapshot.result, result)
+	}
+
+	// Replace the file in the same way as a sync does.
+	tmp := filepath.Join(dst, "dir", ".key1.tmp")
+	if err := ioutil.WriteFile(tmp, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dst, "dir", "key1")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(snapshot.path, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a" {
+		t.Errorf("content of snapshot: got %q, want %q", data, "a")
+	}
+
+	if err := snapshot.remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(snapshot.path); !os.IsNotExist(err) {
+		t.Errorf("snapshot is not removed: %v", err)
+	}
+}
+
+func TestSyncerSnapshotNested(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inner := filepath.Join(dir, "inner")
+	if err := os.Mkdir(inner, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(inner, "key"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := (&syncer{dst: inner}).snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.remove()
+
+	// The snapshot of the inner destination directory is neither a file of
+	// the outer one nor in its snapshots.
+	files, err := newLocalDestination(dir, "", false).list(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files.files) != 1 || files.files[0].compareKey != filepath.Join("inner", "key") {
+		for _, f := range files.files {
+			t.Errorf("file of the outer destination: %s", f.compareKey)
+		}
+	}
+
+	outer, err := (&syncer{dst: dir}).snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outer.remove()
+
+	matches, err := filepath.Glob(filepath.Join(outer.path, snapshotDirPrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) > 0 {
+		t.Errorf("snapshots in the outer snapshot: got %v, want none", matches)
+	}
+}
+
+func TestSameFileSystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "release_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if same, err := sameFileSystem(dir, filepath.Dir(dir)); err != nil || !same {
+		t.Errorf("temporary directory: got %v and %v, want true", same, err)
+	}
+
+	// /proc is a mount point on most Linux systems.
+	info, err := os.Stat("/proc")
+	if err != nil {
+		t.Skip(err)
+	}
+	root, err := os.Stat("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); !ok || st.Dev == root.Sys().(*syscall.Stat_t).Dev {
+		t.Skip("/proc is not a mount point")
+	}
+	if same, err := sameFileSystem("/proc", "/"); err != nil || same {
+		t.Errorf("mount point: got %v and %v, want false", same, err)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// source is where the objects are synced from. The objects in a source are
+// identified by their keys, which are relative to the root of the source.
+type source interface {
+	// list returns the objects whose keys start with the prefix in the
+	// order of their keys, with their sizes, modification times and ETags.
+	list(ctx context.Context, prefix string) ([]*object, error)
+	// open returns the content of the object and its content encoding.
+	open(ctx context.Context, key string) (io.ReadCloser, string, error)
+	// readLink returns the content of the link object.
+	readLink(ctx context.Context, key string) (string, error)
+}
+
+// parseSourceURL parses the src of a sync spec, which is one of
+// s3://bucket/prefix, gs://bucket/prefix, az://account/container/prefix,
+// file:///path/to/dir and http(s)://host/path/to/index.json.
+func parseSourceURL(value string) (*url.URL, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "s3", "gs":
+		if u.Host == "" {
+			return nil, fmt.Errorf("src '%s' has no bucket", value)
+		}
+	case "az":
+		if u.Host == "" || azureContainer(u) == "" {
+			return nil, fmt.Errorf("src '%s' must be in the form of az://account/container/prefix", value)
+		}
+	case "file":
+		if u.Host != "" || !filepath.IsAbs(u.Path) {
+			return nil, fmt.Errorf("src '%s' must be in the form of file:///path/to/dir", value)
+		}
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unknown scheme of src '%s'", value)
+	}
+
+	return u, nil
+}
+
+// sourcePrefix returns the prefix of the keys of the objects to sync from the
+// source at the URL.
+func sourcePrefix(u *url.URL) string {
+	switch u.Scheme {
+	case "az":
+		return strings.TrimPrefix(strings.TrimPrefix(u.Path, "/"+azureContainer(u)), "/")
+	case "http", "https":
+		return ""
+	default:
+		return strings.TrimPrefix(u.Path, "/")
+	}
+}
+
+// sourceLocation returns the URL of the object at the key in the source at
+// the URL, or in the S3 bucket if the URL is nil.
+func sourceLocation(u *url.URL, bucket, key string) string {
+	if u == nil {
+		return fmt.Sprintf("s3://%s/%s", bucket, key)
+	}
+
+	switch u.Scheme {
+	case "az":
+		return fmt.Sprintf("az://%s/%s/%s", u.Host, azureContainer(u), key)
+	case "file":
+		return "file:///" + key
+	case "http", "https":
+		return u.ResolveReference(&url.URL{Path: key}).String()
+	default:
+		return fmt.Sprintf("%s://%s/%s", u.Scheme, u.Host, key)
+	}
+}
+
+func newSource(u *url.URL, limiter *rateLimiter) source {
+	switch u.Scheme {
+	case "gs":
+		return newGCSSource(u.Host, limiter)
+	case "az":
+		return newAzureSource(u.Host, azureContainer(u), limiter)
+	case "file":
+		return &fileSource{}
+	default:
+		return &httpIndexSource{url: u, limiter: limiter}
+	}
+}
+
+// s3Source is an S3 bucket.
+type s3Source struct {
+	bucket  string
+	limiter *rateLimiter
+	s3Api   s3iface.S3API
+}
+
+func (s *s3Source) list(ctx context.Context, prefix string) ([]*object, error) {
+	var objects []*object
+	input := s3.ListObjectsV2Input{Bucket: aws.String(s.bucket), Prefix: aws.String(prefix)}
+	err := s.s3Api.ListObjectsV2PagesWithContext(ctx, &input, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range output.Contents {
+			objects = append(objects, &object{
+				etag:    aws.StringValue(o.ETag),
+				key:     aws.StringValue(o.Key),
+				modTime: aws.TimeValue(o.LastModified),
+				size:    aws.Int64Value(o.Size),
+			})
+		}
+		return true
+	}, s.limiter.requestOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (s *s3Source) open(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	output, _, err := s.get(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+	return output.Body, aws.StringValue(output.ContentEncoding), nil
+}
+
+// get gets the object and returns the response headers, which include the
+// additional checksums stored with it.
+func (s *s3Source) get(ctx context.Context, key string) (*s3.GetObjectOutput, http.Header, error) {
+	var header http.Header
+	input := s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)}
+	opts := append(s.limiter.requestOptions(), checksumModeOption(&header), func(r *request.Request) {
+		// Prevent the HTTP transport from transparently decompressing
+		// objects stored with Content-Encoding: gzip.
+		r.HTTPRequest.Header.Set("Accept-Encoding", "identity")
+	})
+	output, err := s.s3Api.GetObjectWithContext(ctx, &input, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	return output, header, nil
+}
+
+func (s *s3Source) readLink(ctx context.Context, key string) (string, error) {
+	content, _, err := readLinkObject(ctx, s.s3Api, s.limiter, s.bucket, key, "", "")
+	return content, err
+}
+
+// readLink reads the content of the link object opened from the source.
+func readLink(ctx context.Context, src source, limiter *rateLimiter, key string) (string, error) {
+	r, _, err := src.open(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	body, err := ioutil.ReadAll(limiter.reader(ctx, r))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(body), "\r\n"), nil
+}
+
+// getHTTP sends the request after waiting for the request rate limit, and
+// returns the response if its status is 200 OK.
+func getHTTP(ctx context.Context, limiter *rateLimiter, req *http.Request) (*http.Response, error) {
+	if err := limiter.waitRequest(ctx); err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		// The query is omitted as it may have credentials such as SAS tokens.
+		return nil, fmt.Errorf("unexpected status %s from %s://%s%s: %s", resp.Status, req.URL.Scheme, req.URL.Host, req.URL.Path, body)
+	}
+
+	return resp, nil
+}
+
+// fileSource is the local file system, whose keys are the absolute paths of
+// the regular files without the leading slash.
+type fileSource struct{}
+
+func (s *fileSource) list(ctx context.Context, prefix string) ([]*object, error) {
+	dir := "/" + prefix
+	if !strings.HasSuffix(dir, "/") {
+		dir = filepath.Dir(dir)
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	var objects []*object
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		key := strings.TrimPrefix(path, "/")
+		if !info.Mode().IsRegular() || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		objects = append(objects, &object{
+			key:     key,
+			modTime: info.ModTime(),
+			size:    info.Size(),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].key < objects[j].key })
+	return objects, nil
+}
+
+func (s *fileSource) open(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	file, err := os.Open("/" + key)
+	if err != nil {
+		return nil, "", err
+	}
+	return file, "", nil
+}
+
+func (s *fileSource) readLink(ctx context.Context, key string) (string, error) {
+	return readLink(ctx, s, nil, key)
+}
+
+// httpIndexSource is a JSON index of the objects served over HTTP, such as
+//
+//	{"objects": [{"key": "a/b", "size": 1, "lastModified": "2019-01-02T03:04:05Z", "etag": "..."}]}
+//
+// The objects are downloaded from their urls if specified, or from their keys
+// relative to the index otherwise.
+type httpIndexSource struct {
+	url     *url.URL
+	limiter *rateLimiter
+	// urls are the URLs of the objects in the index last listed.
+	urls map[string]string
+}
+
+type httpIndex struct {
+	Objects []struct {
+		Key          string    `json:"key"`
+		Size         int64     `json:"size"`
+		LastModified time.Time `json:"lastModified"`
+		ETag         string    `json:"etag"`
+		URL          string    `json:"url"`
+	} `json:"objects"`
+}
+
+func (s *httpIndexSource) list(ctx context.Context, prefix string) ([]*object, error) {
+	req, err := http.NewRequest(http.MethodGet, s.url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := getHTTP(ctx, s.limiter, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var index httpIndex
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, fmt.Errorf("error decoding index %s: %v", s.url, err)
+	}
+
+	var objects []*object
+	s.urls = make(map[string]string)
+	for _, o := range index.Objects {
+		if !strings.HasPrefix(o.Key, prefix) {
+			continue
+		}
+		objects = append(objects, &object{
+			etag:    o.ETag,
+			key:     o.Key,
+			modTime: o.LastModified,
+			size:    o.Size,
+		})
+		if o.URL != "" {
+			u, err := s.url.Parse(o.URL)
+			if err != nil {
+				return nil, err
+			}
+			s.urls[o.Key] = u.String()
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].key < objects[j].key })
+	return objects, nil
+}
+
+func (s *httpIndexSource) open(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	u, ok := s.urls[key]
+	if !ok {
+		u = sourceLocation(s.url, "", key)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	// Prevent the HTTP transport from transparently decompressing the
+	// objects served with Content-Encoding: gzip.
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := getHTTP(ctx, s.limiter, req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return resp.Body, resp.Header.Get("Content-Encoding"), nil
+}
+
+func (s *httpIndexSource) readLink(ctx context.Context, key string) (string, error) {
+	return readLink(ctx, s, s.limiter, key)
+}
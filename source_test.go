@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSourceURL(t *testing.T) {
+	tests := []struct {
+		src      string
+		prefix   string
+		location string
+	}{
+		{src: "gs://bucket/a/b", prefix: "a/b", location: "gs://bucket/a/b/c"},
+		{src: "az://account/container/a/b", prefix: "a/b", location: "az://account/container/a/b/c"},
+		{src: "az://account/container", prefix: "", location: "az://account/container/a/b/c"},
+		{src: "file:///a/b", prefix: "a/b", location: "file:///a/b/c"},
+		{src: "https://example.com/x/index.json", prefix: "", location: "https://example.com/x/a/b/c"},
+	}
+
+	for _, test := range tests {
+		u, err := parseSourceURL(test.src)
+		if err != nil {
+			t.Fatalf("%s: %v", test.src, err)
+		}
+		if prefix := sourcePrefix(u); prefix != test.prefix {
+			t.Errorf("%s, prefix: got %s, want %s", test.src, prefix, test.prefix)
+		}
+		if location := sourceLocation(u, "", "a/b/c"); location != test.location {
+			t.Errorf("%s, location: got %s, want %s", test.src, location, test.location)
+		}
+	}
+
+	for _, src := range []string{"gs:///a", "az://account", "file://host/a", "file:a", "ftp://host/a"} {
+		if _, err := parseSourceURL(src); err == nil {
+			t.Errorf("%s: got no error", src)
+		}
+	}
+}
+
+func TestSyncSpecSource(t *testing.T) {
+	var v syncValue
+	if err := v.Set("src=s3://bucket/a/b,dst=/dst"); err != nil {
+		t.Fatal(err)
+	}
+	if s := v.specs[0]; s.src != nil || s.bucket != "bucket" || s.prefix != "a/b" {
+		t.Errorf("s3 src: got src=%v bucket=%s prefix=%s", s.src, s.bucket, s.prefix)
+	}
+
+	if err := v.Set("src=gs://bucket/a/b,dst=/dst"); err != nil {
+		t.Fatal(err)
+	}
+	csv, err := v.specs[1].toCSV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(csv, "src=gs://bucket/a/b,dst=/dst,") {
+		t.Errorf("gs src: got %s", csv)
+	}
+
+	for _, value := range []string{
+		"src=gs://bucket/a,bucket=bucket,dst=/dst",
+		"src=gs://bucket/a,archive=true,dst=/dst",
+		"src=gs://bucket/a,checksum=sha256,dst=/dst",
+	} {
+		if err := v.Set(value); err == nil {
+			t.Errorf("%s: got no error", value)
+		}
+	}
+}
+
+func TestSyncFromFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{"src/key1": "a", "src/dir/key2": "bb", "srcx/key3": "c"}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u, err := parseSourceURL("file://" + filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &syncer{src: u, prefix: sourcePrefix(u), source: newSource(u, nil)}
+	d := newMemoryDestination()
+	if _, _, _, err := s.syncTo(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string)
+	for key, f := range d.files {
+		got[key] = f.content
+	}
+	want := map[string]string{"key1": "a", "dir/key2": "bb"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSyncFromHTTPIndexSource(t *testing.T) {
+	modTime := time.Now().Truncate(time.Second).UTC()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/x/index.json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"objects": [
+			{"key": "b/key2", "size": 2, "lastModified": %q, "etag": "2"},
+			{"key": "a/key1", "size": 1, "lastModified": %q, "etag": "1", "url": "/blobs/1"}
+		]}`, modTime.Format(time.RFC3339), modTime.Format(time.RFC3339))
+	})
+	mux.HandleFunc("/blobs/1", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "a") })
+	mux.HandleFunc("/x/b/key2", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "bb") })
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	u, err := parseSourceURL(server.URL + "/x/index.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &syncer{src: u, prefix: sourcePrefix(u), source: newSource(u, nil)}
+	d := newMemoryDestination()
+	if _, _, _, err := s.syncTo(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]*memoryDestinationFile{
+		"a/key1": {content: "a", modTime: modTime},
+		"b/key2": {content: "bb", modTime: modTime},
+	}
+	if !reflect.DeepEqual(d.files, want) {
+		t.Errorf("got %v, want %v", d.files, want)
+	}
+}
+
+func TestSyncFromHTTPIndexSourceEscapingKey(t *testing.T) {
+	for _, key := range []string{"../key", "a/../../key", "/etc/key"} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"objects": [{"key": %q, "size": 1, "etag": "1"}]}`, key)
+		}))
+
+		u, err := parseSourceURL(server.URL + "/index.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &syncer{src: u, prefix: sourcePrefix(u), source: newSource(u, nil)}
+		d := newMemoryDestination()
+		if _, _, _, err := s.syncTo(context.Background(), d); err == nil {
+			t.Errorf("key=%s: got no error", key)
+		}
+		if len(d.files) > 0 {
+			t.Errorf("key=%s: got %v, want no files", key, d.files)
+		}
+		server.Close()
+	}
+}
+
+func TestGCSSourceAccessToken(t *testing.T) {
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"access_token":"token","expires_in":3600}`)
+	}))
+	defer server.Close()
+
+	tokenURL := gcpMetadataTokenURL
+	gcpMetadataTokenURL = server.URL
+	defer func() { gcpMetadataTokenURL = tokenURL }()
+
+	// A failure of the metadata server does not turn to anonymous reads.
+	s := newGCSSource("bucket", nil)
+	if _, err := s.accessToken(context.Background()); err == nil {
+		t.Error("metadata server failure: got no error")
+	}
+	status = http.StatusOK
+	if token, err := s.accessToken(context.Background()); err != nil || token != "token" {
+		t.Errorf("got %q and %v, want %q", token, err, "token")
+	}
+
+	if !isHostNotFound(&url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "metadata.google.internal"}}}) {
+		t.Error("unresolved metadata server: got false, want true")
+	}
+}
+
+func TestGCSSourceList(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/storage/v1/b/bucket/o" || r.URL.Query().Get("prefix") != "a/" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("pageToken") == "" {
+			fmt.Fprint(w, `{"items": [{"name": "a/1", "size": "1", "updated": "2019-01-02T03:04:05Z", "etag": "e1"}], "nextPageToken": "t"}`)
+		} else {
+			fmt.Fprint(w, `{"items": [{"name": "a/2", "size": "22", "updated": "2019-01-02T03:04:05Z", "etag": "e2"}]}`)
+		}
+	}))
+	defer server.Close()
+
+	s := &gcsSource{bucket: "bucket", endpoint: server.URL}
+	objects, err := s.list(context.Background(), "a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	want := []*object{
+		{etag: "e1", key: "a/1", modTime: modTime, size: 1},
+		{etag: "e2", key: "a/2", modTime: modTime, size: 22},
+	}
+	if !reflect.DeepEqual(objects, want) {
+		t.Errorf("got %v, want %v", objects, want)
+	}
+}
+
+func TestAzureSourceList(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/container" || query.Get("comp") != "list" || query.Get("sig") != "s" {
+			http.NotFound(w, r)
+			return
+		}
+		blob := `<Blob><Name>%s</Name><Properties><Last-Modified>Wed, 02 Jan 2019 03:04:05 GMT</Last-Modified><Etag>%s</Etag><Content-Length>%d</Content-Length></Properties></Blob>`
+		if query.Get("marker") == "" {
+			fmt.Fprintf(w, `<EnumerationResults><Blobs>`+blob+`</Blobs><NextMarker>m</NextMarker></EnumerationResults>`, "a/1", "e1", 1)
+		} else {
+			fmt.Fprintf(w, `<EnumerationResults><Blobs>`+blob+`</Blobs><NextMarker/></EnumerationResults>`, "a/2", "e2", 22)
+		}
+	}))
+	defer server.Close()
+
+	s := &azureSource{container: "container", endpoint: server.URL, sasToken: "sig=s"}
+	objects, err := s.list(context.Background(), "a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	want := []*object{
+		{etag: "e1", key: "a/1", modTime: modTime, size: 1},
+		{etag: "e2", key: "a/2", modTime: modTime, size: 22},
+	}
+	if !reflect.DeepEqual(objects, want) {
+		t.Errorf("got %v, want %v", objects, want)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	tarBlockSize = 512
+	// maxOctal is the largest value of the 8-byte octal fields of the USTAR
+	// header block, such as the uid and the gid.
+	maxOctal = 07777777
+)
+
+// sparseRegion is a region of a sparse file holding data, the rest of the
+// file being holes read as zeros.
+type sparseRegion struct {
+	offset int64
+	length int64
+}
+
+// sparseRegions returns the data regions of the file if it has holes, or nil
+// to write the file in full.
+func sparseRegions(file *os.File, info os.FileInfo) ([]sparseRegion, error) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Blocks*512 >= info.Size() {
+		return nil, nil
+	}
+
+	regions, err := dataRegions(file, info.Size())
+	if err != nil || regions == nil {
+		return nil, err
+	}
+	if len(regions) == 1 && regions[0].offset == 0 && regions[0].length == info.Size() {
+		return nil, nil
+	}
+
+	return regions, nil
+}
+
+// writeSparseFile writes the file in the PAX format 1.0 of the GNU sparse
+// files, which archive/tar reads but cannot write. The entry is named
+// GNUSparseFile.0/<name> and holds the map of the data regions followed by
+// the data, while the PAX records hold the real name and size of the file.
+func (w *tarballWriter) writeSparseFile(header *tar.Header, file *os.File, regions []sparseRegion) error {
+	var sparseMap bytes.Buffer
+	entries := regions
+	if n := len(regions); n == 0 || regions[n-1].offset+regions[n-1].length < header.Size {
+		entries = append(entries[:n:n], sparseRegion{offset: header.Size})
+	}
+	fmt.Fprintf(&sparseMap, "%d\n", len(entries))
+	for _, r := range entries {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", r.offset, r.length)
+	}
+	sparseMap.Write(make([]byte, padding(int64(sparseMap.Len()))))
+
+	size := int64(sparseMap.Len())
+	for _, r := range regions {
+		size += r.length
+	}
+
+	dir, base := path.Split(header.Name)
+	name := path.Join(dir, "GNUSparseFile.0", base)
+	records := [][2]string{
+		{"GNU.sparse.major", "1"},
+		{"GNU.sparse.minor", "0"},
+		{"GNU.sparse.name", header.Name},
+		{"GNU.sparse.realsize", strconv.FormatInt(header.Size, 10)},
+	}
+	if len(name) > 100 {
+		records = append(records, [2]string{"path", name})
+	}
+	if size >= 1<<33 {
+		records = append(records, [2]string{"size", strconv.FormatInt(size, 10)})
+	}
+	records = append(records, ownerRecords(header)...)
+	keys := make([]string, 0, len(header.PAXRecords))
+	for k := range header.PAXRecords {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		records = append(records, [2]string{k, header.PAXRecords[k]})
+	}
+
+	var pax bytes.Buffer
+	for _, r := range records {
+		pax.WriteString(paxRecord(r[0], r[1]))
+	}
+
+	// Finish the previous entry before writing the blocks directly.
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	paxHeader := *header
+	paxHeader.Name = path.Join(dir, "PaxHeaders.0", base)
+	paxHeader.Mode = 0644
+	if err := w.writeBlocks(ustarHeader(&paxHeader, 'x', int64(pax.Len())), pax.Bytes()); err != nil {
+		return err
+	}
+
+	mainHeader := *header
+	mainHeader.Name = name
+	if err := w.writeBlocks(ustarHeader(&mainHeader, tar.TypeReg, size), sparseMap.Bytes()); err != nil {
+		return err
+	}
+
+	for _, r := range regions {
+		if _, err := file.Seek(r.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w.w, file, r.length); err == io.EOF {
+			return &fileChangedError{path: file.Name()}
+		} else if err != nil {
+			return err
+		}
+	}
+	_, err := w.w.Write(make([]byte, padding(size-int64(sparseMap.Len()))))
+
+	return err
+}
+
+// writeBlocks writes the header and the data padded to the block size.
+func (w *tarballWriter) writeBlocks(header, data []byte) error {
+	if _, err := w.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	_, err := w.w.Write(make([]byte, padding(int64(len(data)))))
+	return err
+}
+
+func padding(n int64) int64 {
+	return -n & (tarBlockSize - 1)
+}
+
+// paxRecord returns the PAX record of the key and the value, which starts
+// with its own length in decimal.
+func paxRecord(key, value string) string {
+	record := " " + key + "=" + value + "\n"
+	size := len(record)
+	for n := 0; n != len(strconv.Itoa(size)); {
+		n = len(strconv.Itoa(size))
+		size = len(record) + n
+	}
+	return strconv.Itoa(size) + record
+}
+
+// ownerRecords returns the PAX records of the owner of the entry whose values
+// do not fit in the USTAR header block.
+func ownerRecords(header *tar.Header) [][2]string {
+	var records [][2]string
+	if header.Uid > maxOctal {
+		records = append(records, [2]string{"uid", strconv.Itoa(header.Uid)})
+	}
+	if header.Gid > maxOctal {
+		records = append(records, [2]string{"gid", strconv.Itoa(header.Gid)})
+	}
+	if len(header.Uname) > 32 {
+		records = append(records, [2]string{"uname", header.Uname})
+	}
+	if len(header.Gname) > 32 {
+		records = append(records, [2]string{"gname", header.Gname})
+	}
+	return records
+}
+
+// ustarHeader returns the USTAR header block of the entry, whose fields not
+// fitting in the block are expected to be in the preceding PAX records.
+func ustarHeader(header *tar.Header, typeflag byte, size int64) []byte {
+	block := make([]byte, tarBlockSize)
+	copy(block[0:100], header.Name)
+	formatOctal(block[100:108], header.Mode&07777)
+	formatOctal(block[108:116], int64(header.Uid))
+	formatOctal(block[116:124], int64(header.Gid))
+	formatOctal(block[124:136], size)
+	formatOctal(block[136:148], header.ModTime.Unix())
+	block[156] = typeflag
+	copy(block[257:263], "ustar\x00")
+	copy(block[263:265], "00")
+	copy(block[265:297], header.Uname)
+	copy(block[297:329], header.Gname)
+
+	copy(block[148:156], "        ")
+	var sum int64
+	for _, c := range block {
+		sum += int64(c)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	return block
+}
+
+// formatOctal writes the value in octal terminated by a NUL, or zero if it
+// does not fit in the field.
+func formatOctal(b []byte, v int64) {
+	s := strconv.FormatInt(v, 8)
+	if v < 0 || len(s) >= len(b) {
+		s = "0"
+	}
+	copy(b, strings.Repeat("0", len(b)-1-len(s))+s+"\x00")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// The whence values of lseek(2) to find the data and the holes of a file.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// dataRegions returns the data regions of the file found with lseek(2), or
+// nil if the file system does not support finding them.
+func dataRegions(file *os.File, size int64) ([]sparseRegion, error) {
+	fd := int(file.Fd())
+	regions := []sparseRegion{}
+	for offset := int64(0); offset < size; {
+		start, err := unix.Seek(fd, offset, seekData)
+		if err == unix.ENXIO {
+			break
+		} else if err == unix.EINVAL {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		end, err := unix.Seek(fd, start, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if end > size {
+			end = size
+		}
+		if start >= end {
+			break
+		}
+
+		regions = append(regions, sparseRegion{offset: start, length: end - start})
+		offset = end
+	}
+
+	return regions, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// dataRegions returns nil as finding the data regions of a file is only
+// supported on Linux.
+func dataRegions(file *os.File, size int64) ([]sparseRegion, error) {
+	return nil, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteSparseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sparse_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := os.Create(filepath.Join(dir, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteAt([]byte("b"), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Truncate(2 << 20); err != nil {
+		t.Fatal(err)
+	}
+
+	header := &tar.Header{
+		Name:       strings.Repeat("d/", 60) + "sparse",
+		Mode:       0644,
+		Uid:        1 << 22,
+		Gid:        1 << 23,
+		Uname:      strings.Repeat("u", 40),
+		Gname:      strings.Repeat("g", 40),
+		Size:       2 << 20,
+		ModTime:    time.Unix(1546398245, 0),
+		PAXRecords: map[string]string{"SCHILY.xattr.user.etag": `"abc"`},
+	}
+	var tarball bytes.Buffer
+	w := newTarballWriter(&tarball, tarballOptions{})
+	if err := w.writeSparseFile(header, file, []sparseRegion{{offset: 1 << 20, length: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := tar.NewReader(&tarball)
+	got, err := reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != header.Name || got.Size != header.Size || got.Uid != header.Uid || got.Gid != header.Gid || got.Uname != header.Uname || got.Gname != header.Gname {
+		t.Errorf("header: got %+v, want %+v", got, header)
+	}
+	if etag := got.PAXRecords["SCHILY.xattr.user.etag"]; etag != `"abc"` {
+		t.Errorf("PAX record: got %q, want %q", etag, `"abc"`)
+	}
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 2<<20)
+	want[1<<20] = 'b'
+	if !bytes.Equal(content, want) {
+		t.Error("content: got different content")
+	}
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"context"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
 	"log"
 	"math/rand"
-	"os"
-	"path"
+	"net/http"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -21,113 +25,274 @@ import (
 )
 
 type syncer struct {
-	bucket              string
+	spec   *syncSpec
+	src    *url.URL
+	bucket string
+	// resolvedBucket is the bucket the links in the prefix resolved to in
+	// the last sync.
+	resolvedBucket      string
 	prefix              string
 	dst                 string
+	imagePath           string
 	linkObjectKeyRegexp *regexp.Regexp
+	marker              string
+	checksum            string
+	decompress          string
+	stripExtension      bool
+	archive             bool
+	onRelease           string
+	limiter             *rateLimiter
 	s3Api               s3iface.S3API
+	// dstS3Api is the client of the bucket of an S3 destination.
+	dstS3Api s3iface.S3API
+	// source is the source of the objects if it is not the S3 bucket.
+	source   source
+	keychain *keychain
+	// links caches the link objects read by the last sync.
+	links  *linkCache
+	result *syncResult
+	// mutex is held while the destination directory is updated or a
+	// snapshot of it is taken.
+	mutex sync.Mutex
 }
 
-func newSyncer(
-	region, bucket, prefix, dst string,
-	linkObjectKeyRegexp *regexp.Regexp,
-	awsClientFactory awsClientFactory,
-) *syncer {
+func newSyncer(spec *syncSpec, limiter *rateLimiter, awsClientFactory awsClientFactory, registryAuths []*registryAuthSpec) *syncer {
+	limiter = newRateLimiter(limiter, spec.maxRequestsPerSecond, spec.maxBandwidth)
+	var src source
+	if spec.src != nil {
+		src = newSource(spec.src, limiter)
+	}
+	var dstS3Api s3iface.S3API
+	if isS3Destination(spec.dst) {
+		region := spec.dstRegion
+		if region == "" {
+			region = spec.region
+		}
+		dstS3Api = awsClientFactory.newS3(region)
+	}
 	return &syncer{
-		bucket:              bucket,
-		prefix:              prefix,
-		dst:                 dst,
-		linkObjectKeyRegexp: linkObjectKeyRegexp,
-		s3Api:               awsClientFactory.newS3(region),
+		spec:                spec,
+		src:                 spec.src,
+		bucket:              spec.bucket,
+		prefix:              spec.prefix,
+		dst:                 spec.dst,
+		imagePath:           spec.imagePath,
+		linkObjectKeyRegexp: spec.linkObjectKeyRegexp,
+		marker:              spec.marker,
+		checksum:            spec.checksum,
+		decompress:          spec.decompress,
+		stripExtension:      spec.stripExtension,
+		archive:             spec.archive,
+		onRelease:           spec.onRelease,
+		limiter:             limiter,
+		s3Api:               awsClientFactory.newS3(spec.region),
+		dstS3Api:            dstS3Api,
+		source:              src,
+		keychain:            newKeychain(awsClientFactory, registryAuths),
+		links:               newLinkCache(),
 	}
 }
 
 func (s *syncer) sync(ctx context.Context) (bool, error) {
-	path := s.dst
-	if !strings.HasSuffix(path, string(filepath.Separator)) {
-		path += string(filepath.Separator)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.archive {
+		return s.syncArchive(ctx)
+	}
+	if isImageDestination(s.dst) {
+		return s.syncImage(ctx)
+	}
+	if isS3Destination(s.dst) {
+		return s.syncBucket(ctx)
 	}
-	destination := destination{path: path}
 
-	prefix, err := s.resolveLinks(ctx, s.prefix)
+	prefix, objects, err := s.listObjects(ctx)
 	if err != nil {
 		return false, err
 	}
-	if !strings.HasSuffix(prefix, "/") {
-		prefix += "/"
+
+	result := newSyncResult(s.resolvedBucket, prefix, objects.objects)
+	last := s.previousResult()
+	released := last != nil && last.location(s.src) != result.location(s.src)
+	atomic := false
+	if released {
+		if atomic, err = s.canSwitchRelease(); err != nil {
+			return false, err
+		}
+		if !atomic {
+			log.Printf("%s is a mount point, which cannot be exchanged with a staging directory, so it is switched from %s to %s in place, not atomically\n", s.dst, last.location(s.src), result.location(s.src))
+		}
 	}
-	source := source{
-		bucket:              s.bucket,
-		prefix:              prefix,
-		linkObjectKeyRegexp: s.linkObjectKeyRegexp,
-		s3Api:               s.s3Api,
+
+	var changed bool
+	if atomic {
+		if changed, err = s.switchRelease(ctx, last, result, objects); err != nil {
+			return false, err
+		}
+	} else {
+		d := newLocalDestination(s.dst, s.markerPath(), s.decompress != "")
+		if changed, err = s.updateDestination(ctx, d, objects); err != nil {
+			return false, err
+		}
+		if released {
+			result.previousResolvedPrefix = last.resolvedPrefix
+			result.releaseTime = time.Now().UTC()
+		} else if last != nil {
+			result.previousResolvedPrefix = last.previousResolvedPrefix
+			result.releaseTime = last.releaseTime
+		}
+		if err := s.updateMarker(last, result); err != nil {
+			return false, err
+		}
+	}
+	s.result = result
+
+	if released {
+		s.runReleaseHook(ctx, result)
 	}
 
-	files, err := destination.files()
+	return changed, nil
+}
+
+// syncTo updates the files in the destination with the objects under the
+// resolved prefix, and reports whether any file was changed.
+func (s *syncer) syncTo(ctx context.Context, d destination) (string, *objectIterator, bool, error) {
+	prefix, objects, err := s.listObjects(ctx)
 	if err != nil {
-		return false, err
+		return "", nil, false, err
 	}
 
-	objects, err := source.objects(ctx)
+	changed, err := s.updateDestination(ctx, d, objects)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	return prefix, objects, changed, nil
+}
+
+// updateDestination updates the files in the destination with the objects,
+// and reports whether any file was changed.
+func (s *syncer) updateDestination(ctx context.Context, d destination, objects *objectIterator) (bool, error) {
+	files, err := d.list(ctx)
 	if err != nil {
 		return false, err
 	}
 
 	added, removed := s.diff(files, objects)
 
-	if err := s.updateFiles(ctx, added); err != nil {
+	if err := s.updateFiles(ctx, d, added); err != nil {
 		return false, err
 	}
 
-	if err := s.removeFiles(removed); err != nil {
+	if err := s.removeFiles(ctx, d, removed); err != nil {
 		return false, err
 	}
 
 	return len(added) > 0 || len(removed) > 0, nil
 }
 
-func (s *syncer) resolveLinks(ctx context.Context, key string) (string, error) {
-	if s.linkObjectKeyRegexp == nil {
-		return key, nil
+// listObjects resolves the links in the prefix and lists the objects under the
+// resolved prefix.
+func (s *syncer) listObjects(ctx context.Context) (string, *objectIterator, error) {
+	bucket, prefix, err := s.resolveLinks(ctx, s.prefix)
+	if err != nil {
+		return "", nil, err
+	}
+	s.resolvedBucket = bucket
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
 	}
 
-	var k string
-	for _, c := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
-		if len(k) > 0 {
-			k += "/"
+	objects, err := s.objectSource().list(ctx, prefix)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The link objects are copied as they are to S3 destinations.
+	if s.linkObjectKeyRegexp != nil && !isS3Destination(s.dst) {
+		if err := s.readSymlinks(ctx, objects); err != nil {
+			return "", nil, err
 		}
-		k += c
-		if s.linkObjectKeyRegexp.MatchString(k) {
-			var err error
-			if k, err = s.resolveLink(ctx, k); err != nil {
-				return "", err
-			}
+	}
+	s.links.prune()
+
+	for _, o := range objects {
+		o.compareKey = strings.TrimPrefix(o.key, prefix)
+		if !isLocalKey(o.compareKey) {
+			return "", nil, fmt.Errorf("key of %s is an absolute path or has .. elements, which would be synced outside the destination", s.location(o.key))
+		}
+		if o.link == "" {
+			o.compression = compressionByKey(s.decompress, o.key)
+		}
+	}
+	if s.stripExtension {
+		if err := stripExtensions(objects); err != nil {
+			return "", nil, err
 		}
 	}
-	return k, nil
+
+	return prefix, &objectIterator{objects: objects}, nil
 }
 
-func (s *syncer) resolveLink(ctx context.Context, key string) (string, error) {
-	dst, err := readLinkObject(ctx, s.s3Api, s.bucket, key)
-	if err != nil {
-		return "", err
+// isLocalKey reports whether the file at the key is in the destination, i.e.
+// the key is neither an absolute path nor has .. elements.
+func isLocalKey(key string) bool {
+	if filepath.IsAbs(key) || strings.HasPrefix(key, "/") {
+		return false
 	}
-	return path.Join(path.Dir(key), dst), nil
+	for _, element := range strings.Split(filepath.ToSlash(key), "/") {
+		if element == ".." {
+			return false
+		}
+	}
+	return true
 }
 
-func readLinkObject(ctx context.Context, s3Api s3iface.S3API, bucket, key string) (string, error) {
-	input := s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}
-	output, err := s3Api.GetObjectWithContext(ctx, &input)
-	if err != nil {
-		return "", err
+// objectSource returns the source of the objects, which is the S3 bucket
+// unless the sync spec has a src of another kind.
+func (s *syncer) objectSource() source {
+	if s.source != nil {
+		return s.source
 	}
+	return &s3Source{bucket: s.objectBucket(), limiter: s.limiter, s3Api: s.s3Api}
+}
 
-	body, err := ioutil.ReadAll(output.Body)
-	if err != nil {
-		return "", err
+// openObject opens the object and returns its content encoding and, if it is
+// opened from S3, the response headers holding its checksums.
+func (s *syncer) openObject(ctx context.Context, key string) (io.ReadCloser, string, http.Header, error) {
+	src := s.objectSource()
+	if src, ok := src.(*s3Source); ok {
+		output, header, err := src.get(ctx, key)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return output.Body, aws.StringValue(output.ContentEncoding), header, nil
 	}
+	r, contentEncoding, err := src.open(ctx, key)
+	return r, contentEncoding, nil, err
+}
 
-	return strings.TrimRight(string(body), "\r\n"), nil
+// objectBucket returns the bucket of the objects under the resolved prefix,
+// which is another bucket than the one in the sync spec if a link refers to it.
+func (s *syncer) objectBucket() string {
+	if s.resolvedBucket != "" {
+		return s.resolvedBucket
+	}
+	return s.bucket
+}
+
+// location returns the URL of the object at the key in the log messages.
+func (s *syncer) location(key string) string {
+	return sourceLocation(s.src, s.objectBucket(), key)
+}
+
+// lastResult returns the result of the last successful sync, or nil if the
+// syncer has not synced yet.
+func (s *syncer) lastResult() *syncResult {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.result
 }
 
 func (s *syncer) diff(files *fileIterator, objects *objectIterator) (added []*object, removed []*file) {
@@ -141,8 +306,7 @@ func (s *syncer) diff(files *fileIterator, objects *objectIterator) (added []*ob
 
 		switch strings.Compare(file.compareKey, object.compareKey) {
 		case 0:
-			if file.link != object.link ||
-				file.link == "" && (file.size != object.size || file.modTime.Before(object.modTime)) {
+			if file.link != object.link || file.link == "" && s.outdated(file, object) {
 				added = append(added, object)
 			}
 			files.next()
@@ -167,110 +331,236 @@ func (s *syncer) diff(files *fileIterator, objects *objectIterator) (added []*ob
 	return
 }
 
-func (s *syncer) updateFiles(ctx context.Context, objects []*object) error {
-	downloader := s3manager.NewDownloaderWithClient(s.s3Api)
+func (s *syncer) outdated(file *file, object *object) bool {
+	if s.decompress != "" && object.etag != "" {
+		return file.etag != object.etag
+	}
+	return file.size != object.size || file.modTime.Before(object.modTime)
+}
+
+func (s *syncer) updateFiles(ctx context.Context, d destination, objects []*object) error {
+	// The objects are downloaded in parts concurrently unless the files of the
+	// destination can only be written sequentially.
+	var downloader *s3manager.Downloader
+	if _, ok := d.(sequentialWriter); !ok && s.source == nil {
+		downloader = s3manager.NewDownloaderWithClient(s.s3Api, s3manager.WithDownloaderRequestOptions(s.limiter.requestOptions()...))
+	}
 	for _, o := range objects {
-		if err := s.updateFile(ctx, o, downloader); err != nil {
+		if err := s.updateFile(ctx, d, o, downloader); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (s *syncer) updateFile(ctx context.Context, object *object, downloader *s3manager.Downloader) error {
-	dst := filepath.Join(s.dst, object.compareKey)
+func (s *syncer) updateFile(ctx context.Context, d destination, object *object, downloader *s3manager.Downloader) error {
+	if object.link != "" {
+		log.Printf("Updating %s with a symbolic link to %s...\n", d.location(object.compareKey), object.link)
+		return d.symlink(ctx, object.compareKey, object.link, object.modTime)
+	}
 
-	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
-		return err
+	if c, ok := d.(objectCopier); ok && s.source == nil {
+		log.Printf("Copying %s to %s...\n", s.location(object.key), d.location(object.compareKey))
+		return c.copy(ctx, object.compareKey, s.objectBucket(), object)
 	}
 
-	fileName := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+strconv.Itoa(int(rand.Int31())))
-	if object.link != "" {
-		log.Printf("Updating %s with a symbolic link to %s...\n", dst, object.link)
+	log.Printf("Updating %s with %s...\n", d.location(object.compareKey), s.location(object.key))
 
-		if err := os.Symlink(object.link, fileName); err != nil {
-			return err
-		}
-	} else {
-		log.Printf("Updating %s with s3://%s/%s...\n", dst, s.bucket, object.key)
+	size, etag := object.size, ""
+	if s.decompress != "" {
+		size, etag = -1, object.etag
+	}
+	return d.put(ctx, object.compareKey, size, object.modTime, etag, func(file downloadFile) error {
+		return s.download(ctx, object, file, downloader)
+	})
+}
 
-		file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.ModePerm)
-		if err != nil {
+func (s *syncer) download(ctx context.Context, object *object, file downloadFile, downloader *s3manager.Downloader) error {
+	for attempt := 1; ; attempt++ {
+		var err error
+		if s.decompress != "" {
+			err = s.downloadDecompressed(ctx, object, file)
+		} else {
+			err = s.downloadObject(ctx, object, file, downloader)
+		}
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*checksumMismatchError); !ok {
 			return err
 		}
-		defer file.Close()
+		if attempt >= maxChecksumAttempts {
+			return fmt.Errorf("error verifying %s: %v", s.location(object.key), err)
+		}
+		log.Printf("Error verifying %s: %v. Retrying...\n", s.location(object.key), err)
 
-		input := s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(object.key)}
-		if _, err := downloader.DownloadWithContext(ctx, file, &input); err != nil {
+		// An object streamed to an upload or a layer cannot be downloaded
+		// again.
+		if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil {
+			return fmt.Errorf("error verifying %s: %v: %v", s.location(object.key), err, seekErr)
+		}
+		if err := file.Truncate(0); err != nil {
 			return err
 		}
 	}
+}
+
+// downloadObject downloads the object in parts concurrently, or copies it if
+// it fits in a single part, so that its checksums are read from the response
+// headers of the GET request instead of a HEAD request.
+func (s *syncer) downloadObject(ctx context.Context, object *object, file downloadFile, downloader *s3manager.Downloader) error {
+	if downloader == nil || object.size <= downloader.PartSize {
+		return s.copyObject(ctx, object, file)
+	}
 
-	t := unix.NsecToTimeval(object.modTime.UnixNano())
-	if err := unix.Lutimes(fileName, []unix.Timeval{t, t}); err != nil {
+	checksum, err := s.expectedChecksum(ctx, object, nil)
+	if err != nil {
 		return err
 	}
 
-	if err := os.Rename(fileName, dst); err != nil {
+	input := s3.GetObjectInput{Bucket: aws.String(s.objectBucket()), Key: aws.String(object.key)}
+	if _, err := downloader.DownloadWithContext(ctx, s.limiter.writerAt(ctx, file), &input); err != nil {
 		return err
 	}
 
-	return nil
+	if checksum == nil {
+		return nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return checksum.verify(file)
 }
 
-func (s *syncer) removeFiles(files []*file) error {
-	for _, f := range files {
-		log.Printf("Removing %s...\n", f.path)
+// copyObject copies the object with a single request, from a source other than
+// the S3 bucket, to a file written sequentially or if it fits in a part. The
+// checksum is computed while the object is copied, so that the file is never
+// read back.
+func (s *syncer) copyObject(ctx context.Context, object *object, file downloadFile) error {
+	r, _, header, err := s.openObject(ctx, object.key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
 
-		if err := os.Remove(f.path); err != nil {
-			return err
-		}
+	checksum, err := s.expectedChecksum(ctx, object, header)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	body := s.limiter.reader(ctx, r)
+	var h hash.Hash
+	if checksum != nil {
+		h = checksum.newHash()
+		body = io.TeeReader(body, h)
+	}
+
+	if _, err := io.Copy(file, body); err != nil {
+		return err
+	}
+
+	if checksum == nil {
+		return nil
+	}
+	return checksum.check(h)
+}
+
+// downloadFile is where an object is downloaded to, either a temporary file
+// or a pipe to an upload.
+type downloadFile interface {
+	io.Writer
+	io.WriterAt
+	io.ReadSeeker
+	Truncate(size int64) error
 }
 
-type destination struct {
-	path string
+// streamFile is a download file streaming the content to a writer, such as a
+// pipe to an upload, which can only be written sequentially and cannot be read
+// back or rewound.
+type streamFile struct {
+	w      io.Writer
+	offset int64
 }
 
-func (d *destination) files() (*fileIterator, error) {
-	if _, err := os.Stat(d.path); os.IsNotExist(err) {
-		return &fileIterator{}, nil
+func (f *streamFile) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *streamFile) WriteAt(p []byte, off int64) (int, error) {
+	if off != f.offset {
+		return 0, fmt.Errorf("cannot write at %d of a stream at %d", off, f.offset)
 	}
+	return f.Write(p)
+}
 
-	var files []*file
-	err := filepath.Walk(d.path, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+func (f *streamFile) Read(p []byte) (int, error) {
+	return 0, errors.New("cannot read back a stream")
+}
 
-		if info.IsDir() {
-			return nil
-		}
+func (f *streamFile) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekCurrent || offset == f.offset && whence == io.SeekStart {
+		return f.offset, nil
+	}
+	return 0, fmt.Errorf("cannot rewind a stream at %d", f.offset)
+}
 
-		var link string
-		if info.Mode()&os.ModeSymlink != 0 {
-			if link, err = os.Readlink(path); err != nil {
-				return err
-			}
+func (f *streamFile) Truncate(size int64) error {
+	if size != f.offset {
+		return fmt.Errorf("cannot truncate a stream at %d", f.offset)
+	}
+	return nil
+}
+
+// tempFileName returns the name of a temporary file next to dst, which is
+// renamed to dst once it is complete.
+func tempFileName(dst string) string {
+	return filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+strconv.Itoa(int(rand.Int31())))
+}
+
+func lchtimes(path string, modTime time.Time) error {
+	t := unix.NsecToTimespec(modTime.UnixNano())
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{t, t}, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// objectCopier is a destination that copies the objects from the S3 bucket
+// server-side instead of downloading them.
+type objectCopier interface {
+	copy(ctx context.Context, key, bucket string, object *object) error
+}
+
+// sequentialWriter is a destination whose files can only be written
+// sequentially, which the objects are not downloaded to in parts.
+type sequentialWriter interface {
+	writesSequentially()
+}
+
+// batchDeleter is a destination that deletes multiple files at once.
+type batchDeleter interface {
+	deleteAll(ctx context.Context, keys []string) error
+}
+
+func (s *syncer) removeFiles(ctx context.Context, d destination, files []*file) error {
+	if b, ok := d.(batchDeleter); ok {
+		keys := make([]string, 0, len(files))
+		for _, f := range files {
+			log.Printf("Removing %s...\n", d.location(f.compareKey))
+			keys = append(keys, f.compareKey)
 		}
+		return b.deleteAll(ctx, keys)
+	}
 
-		files = append(files, &file{
-			compareKey: strings.TrimPrefix(path, d.path),
-			link:       link,
-			modTime:    info.ModTime(),
-			path:       path,
-			size:       info.Size(),
-		})
+	for _, f := range files {
+		log.Printf("Removing %s...\n", d.location(f.compareKey))
 
-		return nil
-	})
-	if err != nil {
-		return nil, err
+		if err := d.delete(ctx, f.compareKey); err != nil {
+			return err
+		}
 	}
 
-	return &fileIterator{files: files}, nil
+	return nil
 }
 
 type fileIterator struct {
@@ -295,53 +585,13 @@ func (i *fileIterator) next() *file {
 
 type file struct {
 	compareKey string
+	etag       string
 	link       string
 	modTime    time.Time
 	path       string
 	size       int64
 }
 
-type source struct {
-	bucket              string
-	prefix              string
-	linkObjectKeyRegexp *regexp.Regexp
-	s3Api               s3iface.S3API
-}
-
-func (s *source) objects(ctx context.Context) (*objectIterator, error) {
-	var err error
-	var objects []*object
-
-	input := s3.ListObjectsV2Input{Bucket: aws.String(s.bucket), Prefix: aws.String(s.prefix)}
-	e := s.s3Api.ListObjectsV2PagesWithContext(ctx, &input, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
-		for _, o := range output.Contents {
-			key := aws.StringValue(o.Key)
-			var link string
-			if s.linkObjectKeyRegexp != nil && s.linkObjectKeyRegexp.MatchString(key) {
-				if link, err = readLinkObject(ctx, s.s3Api, s.bucket, key); err != nil {
-					return false
-				}
-			}
-
-			objects = append(objects, &object{
-				compareKey: strings.TrimPrefix(key, s.prefix),
-				key:        key,
-				link:       link,
-				modTime:    aws.TimeValue(o.LastModified),
-				size:       aws.Int64Value(o.Size),
-			})
-		}
-		return true
-	})
-	if e != nil {
-		return nil, e
-	}
-	if err != nil {
-		return nil, err
-	}
-	return &objectIterator{objects: objects}, nil
-}
-
 type objectIterator struct {
 	objects []*object
 	i       int
@@ -364,8 +614,12 @@ func (i *objectIterator) next() *object {
 
 type object struct {
 	compareKey string
-	key        string
-	link       string
-	modTime    time.Time
-	size       int64
+	// compression is the format the object is decompressed from regardless
+	// of its Content-Encoding.
+	compression string
+	etag        string
+	key         string
+	link        string
+	modTime     time.Time
+	size        int64
 }
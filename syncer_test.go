@@ -1,9 +1,14 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -12,9 +17,11 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/klauspost/compress/zstd"
 )
 
 type testFile struct {
@@ -29,8 +36,11 @@ func (o *testFile) size() int64 {
 
 type testObject struct {
 	content      string
+	etag         string
 	key          string
 	lastModified time.Time
+	// sha256 is the additional SHA-256 checksum stored with the object.
+	sha256 string
 }
 
 func (o *testObject) size() int64 {
@@ -39,11 +49,49 @@ func (o *testObject) size() int64 {
 
 type s3Api struct {
 	s3iface.S3API
-	objects []*testObject
+	objects     []*testObject
+	corruptions int
+	// heads is the number of HeadObject requests.
+	heads int
+}
+
+// sendRequest runs the Sign handlers added by the options of a request for the
+// object, which wait for the rate limits before the SDK sends the request, and
+// then the Complete handlers with the response headers, which hold the
+// checksums of the object if they are requested.
+func sendRequest(ctx aws.Context, name string, input interface{}, o *testObject, opts []request.Option) error {
+	r := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, &request.Operation{Name: name}, input, nil)
+	r.SetContext(ctx)
+	r.ApplyOptions(opts...)
+	r.Handlers.Sign.Run(r)
+	if r.Error != nil {
+		return r.Error
+	}
+
+	header := http.Header{}
+	if o != nil && o.sha256 != "" && r.HTTPRequest.Header.Get("x-amz-checksum-mode") == "ENABLED" {
+		header.Set("x-amz-checksum-sha256", o.sha256)
+	}
+	r.HTTPResponse = &http.Response{StatusCode: http.StatusOK, Header: header}
+	r.Handlers.Complete.Run(r)
+	return r.Error
+}
+
+// object returns the object at the key, or nil if there is none.
+func (a *s3Api) object(key *string) *testObject {
+	for _, o := range a.objects {
+		if o.key == aws.StringValue(key) {
+			return o
+		}
+	}
+	return nil
 }
 
 func (a *s3Api) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error {
 	for i, o := range a.objects {
+		if err := sendRequest(ctx, "ListObjectsV2", input, nil, opts); err != nil {
+			return err
+		}
 		output := s3.ListObjectsV2Output{}
 		output.Contents = []*s3.Object{
 			&s3.Object{
@@ -52,22 +100,49 @@ func (a *s3Api) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObj
 				Size:         aws.Int64(o.size()),
 			},
 		}
+		if o.etag != "" {
+			output.Contents[0].ETag = aws.String(o.etag)
+		}
 		fn(&output, len(a.objects) == i+1)
 	}
 	return nil
 }
 
 func (a *s3Api) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
-	for _, o := range a.objects {
-		if o.key != aws.StringValue(input.Key) {
-			continue
-		}
-		output := s3.GetObjectOutput{}
-		output.Body = ioutil.NopCloser(strings.NewReader(o.content))
-		output.ContentLength = aws.Int64(o.size())
-		return &output, nil
+	o := a.object(input.Key)
+	if err := sendRequest(ctx, "GetObject", input, o, opts); err != nil {
+		return nil, err
+	}
+	if o == nil {
+		return nil, fmt.Errorf("object not found. key=%s", aws.StringValue(input.Key))
+	}
+
+	content := o.content
+	if a.corruptions > 0 {
+		a.corruptions--
+		content = content[:len(content)-1] + "x"
+	}
+	output := s3.GetObjectOutput{}
+	output.Body = ioutil.NopCloser(strings.NewReader(content))
+	output.ContentLength = aws.Int64(o.size())
+	return &output, nil
+}
+
+func (a *s3Api) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	a.heads++
+	o := a.object(input.Key)
+	if err := sendRequest(ctx, "HeadObject", input, o, opts); err != nil {
+		return nil, err
+	}
+	if o == nil {
+		return nil, fmt.Errorf("object not found. key=%s", aws.StringValue(input.Key))
 	}
-	return nil, fmt.Errorf("object not found. key=%s", aws.StringValue(input.Key))
+
+	output := s3.HeadObjectOutput{}
+	output.ContentLength = aws.Int64(o.size())
+	output.ETag = aws.String(o.etag)
+	output.LastModified = aws.Time(o.lastModified)
+	return &output, nil
 }
 
 func TestSync(t *testing.T) {
@@ -180,3 +255,319 @@ func testSync(t *testing.T, prefix string, files []*testFile, objects []*testObj
 		}
 	}
 }
+
+func TestSyncMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	modTime := time.Now()
+	api := &s3Api{objects: []*testObject{
+		&testObject{content: "a", key: "prefix/key1", lastModified: modTime},
+		&testObject{content: "aa", key: "prefix/key2", lastModified: modTime},
+	}}
+
+	syncer := syncer{
+		bucket: "bucket",
+		prefix: "prefix",
+		dst:    dir,
+		marker: ".s3-sync.json",
+		s3Api:  api,
+	}
+
+	for i, expected := range []bool{true, false} {
+		changed, err := syncer.sync(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != expected {
+			t.Errorf("syncer.sync #%d: got %t, want %t", i, changed, expected)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, ".s3-sync.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var marker syncMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		t.Fatal(err)
+	}
+	if marker.ResolvedPrefix != "prefix/" {
+		t.Errorf("resolvedPrefix: got %q, want %q", marker.ResolvedPrefix, "prefix/")
+	}
+	if marker.Objects != 2 {
+		t.Errorf("objects: got %d, want %d", marker.Objects, 2)
+	}
+	if marker.Bytes != 3 {
+		t.Errorf("bytes: got %d, want %d", marker.Bytes, 3)
+	}
+	if !strings.HasPrefix(marker.Digest, "sha256:") {
+		t.Errorf("digest: got %q, want sha256 digest", marker.Digest)
+	}
+}
+
+func TestSyncChecksum(t *testing.T) {
+	for _, algorithm := range []string{checksumETag, checksumAuto, checksumSHA256} {
+		testSyncChecksum(t, algorithm, 0, true)
+		testSyncChecksum(t, algorithm, maxChecksumAttempts-1, true)
+		testSyncChecksum(t, algorithm, maxChecksumAttempts, false)
+	}
+}
+
+func testSyncChecksum(t *testing.T, algorithm string, corruptions int, success bool) {
+	dir, err := ioutil.TempDir("", "syncer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	object := &testObject{content: "abc", key: "prefix/key1", lastModified: time.Now()}
+	switch algorithm {
+	case checksumSHA256:
+		object.sha256 = "ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0="
+	default:
+		object.etag = `"900150983cd24fb0d6963f7d28e17f72"`
+	}
+	api := &s3Api{objects: []*testObject{object}, corruptions: corruptions}
+
+	syncer := syncer{
+		bucket:   "bucket",
+		prefix:   "prefix",
+		dst:      dir,
+		checksum: algorithm,
+		s3Api:    api,
+	}
+	_, err = syncer.sync(context.Background())
+	// The checksums are read from the responses of the GET requests.
+	if api.heads != 0 {
+		t.Errorf("%s, corruptions=%d, HEAD requests: got %d, want 0", algorithm, corruptions, api.heads)
+	}
+	if success && err != nil {
+		t.Errorf("%s, corruptions=%d: unexpected error: %v", algorithm, corruptions, err)
+		return
+	}
+	if !success {
+		if err == nil {
+			t.Errorf("%s, corruptions=%d: expected an error", algorithm, corruptions)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "key1")); !os.IsNotExist(err) {
+			t.Errorf("%s, corruptions=%d: expected key1 not to exist", algorithm, corruptions)
+		}
+		return
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "abc" {
+		t.Errorf("%s, corruptions=%d, content: got %q, want %q", algorithm, corruptions, content, "abc")
+	}
+}
+
+func TestExpectedChecksumHead(t *testing.T) {
+	o := &testObject{content: "abc", key: "prefix/key1", sha256: "ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0="}
+	api := &s3Api{objects: []*testObject{o}}
+	s := &syncer{bucket: "bucket", checksum: checksumAuto, s3Api: api}
+
+	// Without the response headers of a GET request, as for the objects
+	// downloaded in parts, the checksums are read with a HEAD request.
+	c, err := s.expectedChecksum(context.Background(), &object{key: o.key}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &checksum{algorithm: checksumSHA256, expected: o.sha256}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("checksum: got %+v, want %+v", c, want)
+	}
+	if api.heads != 1 {
+		t.Errorf("HEAD requests: got %d, want 1", api.heads)
+	}
+}
+
+func TestSyncDecompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var zb bytes.Buffer
+	zw, err := zstd.NewWriter(&zb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Now()
+	object1 := &testObject{content: b.String(), etag: `"etag1"`, key: "prefix/key1.gz", lastModified: modTime}
+	object2 := &testObject{content: "plain", etag: `"etag2"`, key: "prefix/key2", lastModified: modTime}
+	object3 := &testObject{content: zb.String(), etag: `"etag4"`, key: "prefix/key3.zst", lastModified: modTime}
+	api := &s3Api{objects: []*testObject{object1, object2, object3}}
+
+	syncer := syncer{
+		bucket:         "bucket",
+		prefix:         "prefix",
+		dst:            dir,
+		decompress:     decompressAuto,
+		stripExtension: true,
+		s3Api:          api,
+	}
+
+	for i, expected := range []bool{true, false} {
+		changed, err := syncer.sync(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != expected {
+			t.Errorf("syncer.sync #%d: got %t, want %t", i, changed, expected)
+		}
+	}
+
+	for path, expected := range map[string]string{"key1": "hello", "key2": "plain", "key3": "world"} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Errorf("path=%s, content: got %q, want %q", path, content, expected)
+		}
+	}
+
+	object1.etag = `"etag3"`
+	changed, err := syncer.sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Errorf("syncer.sync after changing the ETag: got %t, want %t", changed, true)
+	}
+}
+
+func TestCompressionByKey(t *testing.T) {
+	tests := []struct {
+		mode string
+		key  string
+		want string
+	}{
+		{mode: decompressAuto, key: "key.gz", want: decompressGzip},
+		{mode: decompressAuto, key: "key.zst", want: decompressZstd},
+		{mode: decompressAuto, key: "key.json"},
+		{mode: decompressGzip, key: "key.zst", want: decompressGzip},
+		{mode: decompressZstd, key: "key", want: decompressZstd},
+		{key: "key.gz"},
+	}
+	for _, test := range tests {
+		if got := compressionByKey(test.mode, test.key); got != test.want {
+			t.Errorf("mode=%s, key=%s: got %q, want %q", test.mode, test.key, got, test.want)
+		}
+	}
+}
+
+func TestSyncArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := &testObject{
+		content:      testTarGz(t, map[string]string{"key1": "a", "dir/key2": "aa"}),
+		etag:         `"etag1"`,
+		key:          "releases/bundle.tar.gz",
+		lastModified: time.Now(),
+	}
+	api := &s3Api{objects: []*testObject{archive}}
+
+	syncer := syncer{
+		bucket:  "bucket",
+		prefix:  "releases/bundle.tar.gz",
+		dst:     dir,
+		archive: true,
+		s3Api:   api,
+	}
+
+	for i, expected := range []bool{true, false} {
+		changed, err := syncer.sync(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != expected {
+			t.Errorf("syncer.sync #%d: got %t, want %t", i, changed, expected)
+		}
+	}
+	testFileContents(t, dir, map[string]string{"key1": "a", "dir/key2": "aa"})
+
+	archive.content = testTarGz(t, map[string]string{"key1": "b", "key3": "bbb"})
+	archive.etag = `"etag2"`
+	changed, err := syncer.sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Errorf("syncer.sync after changing the archive: got %t, want %t", changed, true)
+	}
+	testFileContents(t, dir, map[string]string{"key1": "b", "key3": "bbb"})
+}
+
+func testTarGz(t *testing.T, files map[string]string) string {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	tw := tar.NewWriter(zw)
+	for name, content := range files {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: time.Now()}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func testFileContents(t *testing.T, dir string, expected map[string]string) {
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[strings.TrimPrefix(path, dir+string(filepath.Separator))] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("files: got %v, want %v", files, expected)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+var (
+	validTagRegexp   = regexp.MustCompile(`\A[\w][\w.-]{0,127}\z`)
+	invalidTagRegexp = regexp.MustCompile(`[^\w.-]+`)
+	templateAction   = regexp.MustCompile(`\{\{.*?\}\}`)
+	// timeFormatAction and timeUnixAction match the actions formatting the
+	// build time, by which the expanded tags are ordered.
+	timeFormatAction = regexp.MustCompile("\\A\\{\\{-?\\s*\\.Time\\.Format\\s+(?:\"([^\"]*)\"|`([^`]*)`)\\s*-?\\}\\}\\z")
+	timeUnixAction   = regexp.MustCompile(`\A\{\{-?\s*\.Time\.Unix\s*-?\}\}\z`)
+	digestHexAction  = regexp.MustCompile(`\A\{\{-?\s*\.Digest\.Hex\s*-?\}\}\z`)
+	// specAction and buildAction match the actions referring to the sync
+	// specs, which are the same in every build, and to the build.
+	specAction    = regexp.MustCompile(`\.Specs?\b`)
+	buildAction   = regexp.MustCompile(`\.(?:Time|Digest|ResolvedPrefix)\b|resolved-prefix`)
+	timeLayoutRun = regexp.MustCompile(`[0-9]+|[A-Za-z]+|[^0-9A-Za-z]+`)
+	// signatureTagRegexp matches the tags of the signatures and attestations
+	// pushed alongside the images, which are never pruned.
+	signatureTagRegexp = regexp.MustCompile(`\Asha256-[0-9a-f]+\.(sig|att|sbom)\z`)
+)
+
+// tagTemplate is a tag whose name is a text/template expanded on every build,
+// such as `repo:{{.Time.Format "20060102-150405"}}`.
+type tagTemplate struct {
+	repository name.Repository
+	template   *template.Template
+	text       string
+	// pattern matches the tags expanded from the template, which are
+	// pruned by the retention policy. It is compiled for the sync specs.
+	pattern *regexp.Regexp
+	// parseTime parses the build time captured by the pattern, if the
+	// template formats one.
+	parseTime func(string) (time.Time, error)
+}
+
+// tagData is the data the tag templates are expanded with.
+type tagData struct {
+	// Time is the time the build started at.
+	Time time.Time
+	// Digest is the digest of the image or the image index.
+	Digest v1.Hash
+	// Spec holds the name, the source and the destination of the first sync
+	// spec, and Specs those of all the sync specs by name.
+	Spec  map[string]string
+	Specs map[string]map[string]string
+	// ResolvedPrefix is the prefix of the first sync spec after resolving
+	// the link objects.
+	ResolvedPrefix string
+}
+
+func isTagTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+func parseTagTemplate(s string) (*tagTemplate, error) {
+	static := s[:strings.Index(s, "{{")]
+	i := strings.LastIndex(static, ":")
+	if i < 0 || strings.Contains(static[i:], "/") {
+		return nil, fmt.Errorf("invalid tag template '%s' must be in the form of repository:template", s)
+	}
+
+	repository, err := name.NewRepository(s[:i], name.WeakValidation)
+	if err != nil {
+		return nil, err
+	}
+
+	text := s[i+1:]
+	t, err := template.New(s).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tagTemplate{repository: repository, template: t, text: text}, nil
+}
+
+// hasBuildAction reports whether the template formats the build time or the
+// digest, which tell the tags expanded from it apart from the other tags.
+func (t *tagTemplate) hasBuildAction() bool {
+	for _, action := range templateAction.FindAllString(t.text, -1) {
+		if timeFormatAction.MatchString(action) || timeUnixAction.MatchString(action) || digestHexAction.MatchString(action) {
+			return true
+		}
+	}
+	return false
+}
+
+// compile compiles the pattern matching the tags expanded from the template
+// for the sync specs.
+func (t *tagTemplate) compile(specs []*syncSpec) error {
+	data := newTagData(time.Time{}, v1.Hash{}, specs, nil)
+	t.parseTime = nil
+
+	var pattern bytes.Buffer
+	pattern.WriteString(`\A`)
+	literals := templateAction.Split(t.text, -1)
+	actions := templateAction.FindAllString(t.text, -1)
+	for j, literal := range literals {
+		if j > 0 {
+			p, err := t.actionPattern(actions[j-1], data)
+			if err != nil {
+				return err
+			}
+			pattern.WriteString(p)
+		}
+		pattern.WriteString(regexp.QuoteMeta(literal))
+	}
+	pattern.WriteString(`\z`)
+
+	var err error
+	t.pattern, err = regexp.Compile(pattern.String())
+	return err
+}
+
+// actionPattern returns the pattern matching what the action is expanded to:
+// the expansion itself if it only refers to the sync specs, digits and letters
+// in place of the elements of a time layout, hexadecimal digits for a digest
+// and the characters allowed in tags otherwise. The first action formatting
+// the build time is captured to order the tags by.
+func (t *tagTemplate) actionPattern(action string, data *tagData) (string, error) {
+	if specAction.MatchString(action) && !buildAction.MatchString(action) {
+		tmpl, err := template.New(t.template.Name()).Option("missingkey=error").Parse(action)
+		if err != nil {
+			return "", err
+		}
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, data); err != nil {
+			return "", err
+		}
+		return regexp.QuoteMeta(invalidTagRegexp.ReplaceAllString(b.String(), "-")), nil
+	}
+
+	if m := timeFormatAction.FindStringSubmatch(action); m != nil {
+		layout := invalidTagRegexp.ReplaceAllString(m[1]+m[2], "-")
+		var pattern bytes.Buffer
+		for _, run := range timeLayoutRun.FindAllString(layout, -1) {
+			switch {
+			case run[0] >= '0' && run[0] <= '9':
+				pattern.WriteString(`[0-9]+`)
+			case run[0] >= 'A' && run[0] <= 'Z' || run[0] >= 'a' && run[0] <= 'z':
+				pattern.WriteString(`[A-Za-z]+`)
+			default:
+				pattern.WriteString(regexp.QuoteMeta(run))
+			}
+		}
+		if t.parseTime != nil {
+			return `(?:` + pattern.String() + `)`, nil
+		}
+		t.parseTime = func(value string) (time.Time, error) {
+			return time.Parse(layout, value)
+		}
+		return `(` + pattern.String() + `)`, nil
+	}
+
+	if timeUnixAction.MatchString(action) {
+		if t.parseTime != nil {
+			return `[0-9]+`, nil
+		}
+		t.parseTime = func(value string) (time.Time, error) {
+			sec, err := strconv.ParseInt(value, 10, 64)
+			return time.Unix(sec, 0), err
+		}
+		return `([0-9]+)`, nil
+	}
+
+	if digestHexAction.MatchString(action) {
+		return `[0-9a-f]+`, nil
+	}
+	return `[\w.-]+`, nil
+}
+
+// sort orders the tags expanded from the template newest first, by the build
+// time formatted in them if the template has one and by name otherwise.
+func (t *tagTemplate) sort(tags []string) {
+	times := make(map[string]time.Time, len(tags))
+	if t.parseTime != nil {
+		for _, tag := range tags {
+			if m := t.pattern.FindStringSubmatch(tag); m != nil {
+				if parsed, err := t.parseTime(m[1]); err == nil {
+					times[tag] = parsed
+				}
+			}
+		}
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		ti, tj := times[tags[i]], times[tags[j]]
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return tags[i] > tags[j]
+	})
+}
+
+// expand returns the tag expanded from the template, with the characters not
+// allowed in tags replaced by hyphens.
+func (t *tagTemplate) expand(data *tagData) (name.Tag, error) {
+	var b bytes.Buffer
+	if err := t.template.Execute(&b, data); err != nil {
+		return name.Tag{}, err
+	}
+
+	tag := invalidTagRegexp.ReplaceAllString(b.String(), "-")
+	tag = strings.TrimLeft(tag, ".-")
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	if tag == "" {
+		return name.Tag{}, fmt.Errorf("tag template '%s' is expanded to an empty tag", t.template.Name())
+	}
+
+	return name.NewTag(t.repository.Name()+":"+tag, name.WeakValidation)
+}
+
+func newTagData(started time.Time, digest v1.Hash, specs []*syncSpec, results []*syncResult) *tagData {
+	data := &tagData{
+		Time:   started.UTC(),
+		Digest: digest,
+		Specs:  make(map[string]map[string]string, len(specs)),
+	}
+
+	for i, s := range specs {
+		spec := map[string]string{
+			"name":   s.name,
+			"bucket": s.bucket,
+			"prefix": s.prefix,
+			"dst":    s.dst,
+		}
+		if i < len(results) && results[i] != nil {
+			spec["resolved-prefix"] = results[i].resolvedPrefix
+		}
+
+		if i == 0 {
+			data.Spec = spec
+			data.ResolvedPrefix = spec["resolved-prefix"]
+		}
+		if s.name != "" {
+			data.Specs[s.name] = spec
+		}
+	}
+
+	return data
+}
+
+// expandTags returns the tags to push the image to: the static tags, the tags
+// expanded from the templates and the latest tags of their repositories, in a
+// stable order.
+func (b *builder) expandTags(data *tagData) ([]name.Tag, error) {
+	tags := append([]name.Tag(nil), b.tags...)
+	for _, t := range b.tagTemplates {
+		tag, err := t.expand(data)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	for _, repository := range repositories(tags) {
+		for _, latest := range b.latestTags {
+			tag, err := name.NewTag(repository.Name()+":"+latest, name.WeakValidation)
+			if err != nil {
+				return nil, err
+			}
+			tags = append(tags, tag)
+		}
+	}
+
+	seen := make(map[string]bool, len(tags))
+	unique := tags[:0]
+	for _, tag := range tags {
+		if !seen[tag.String()] {
+			seen[tag.String()] = true
+			unique = append(unique, tag)
+		}
+	}
+	sort.Slice(unique, func(i, j int) bool { return unique[i].String() < unique[j].String() })
+
+	return unique, nil
+}
+
+// pruneTags deletes the tags expanded from the templates by the previous
+// builds, except the newest ones up to the retention count. The tags of the
+// signatures and attestations, and those pointing at the same manifest as a
+// kept tag are never deleted, as deleting a tag deletes the manifest.
+func (b *builder) pruneTags(ctx context.Context, current []name.Tag) error {
+	keep := make(map[string]bool)
+	for _, tag := range current {
+		keep[tag.String()] = true
+	}
+	for _, tag := range b.tags {
+		keep[tag.String()] = true
+	}
+
+	for _, t := range b.tagTemplates {
+		if err := t.compile(b.specs); err != nil {
+			return err
+		}
+
+		options := b.remoteOptions(ctx, t.repository)
+		names, err := remote.List(t.repository, options...)
+		if err != nil {
+			return err
+		}
+
+		var matched []string
+		var kept, expired []name.Tag
+		for _, n := range names {
+			tag, err := name.NewTag(t.repository.Name()+":"+n, name.WeakValidation)
+			if err != nil {
+				return err
+			}
+			switch {
+			case b.isLatestTag(n):
+				kept = append(kept, tag)
+			case t.pattern.MatchString(n) && !signatureTagRegexp.MatchString(n):
+				matched = append(matched, n)
+			case keep[tag.String()]:
+				kept = append(kept, tag)
+			}
+		}
+		t.sort(matched)
+
+		for i, n := range matched {
+			tag, err := name.NewTag(t.repository.Name()+":"+n, name.WeakValidation)
+			if err != nil {
+				return err
+			}
+			if i < b.tagRetention || keep[tag.String()] {
+				kept = append(kept, tag)
+			} else {
+				expired = append(expired, tag)
+			}
+		}
+		if len(expired) == 0 {
+			continue
+		}
+
+		referenced := make(map[v1.Hash]bool, len(kept))
+		for _, tag := range kept {
+			descriptor, err := remote.Get(tag, options...)
+			if err != nil {
+				return err
+			}
+			referenced[descriptor.Digest] = true
+		}
+
+		deleted := make(map[v1.Hash]bool, len(expired))
+		for _, tag := range expired {
+			descriptor, err := remote.Get(tag, options...)
+			if err != nil {
+				return err
+			}
+			if referenced[descriptor.Digest] {
+				log.Printf("Keeping %s pointing at %s of a kept tag\n", tag, descriptor.Digest)
+				continue
+			}
+			if deleted[descriptor.Digest] {
+				continue
+			}
+
+			log.Printf("Deleting %s...\n", tag)
+			if err := remote.Delete(tag, options...); err != nil {
+				return err
+			}
+			deleted[descriptor.Digest] = true
+		}
+	}
+
+	return nil
+}
+
+func (b *builder) isLatestTag(tag string) bool {
+	for _, latest := range b.latestTags {
+		if tag == latest {
+			return true
+		}
+	}
+	return false
+}
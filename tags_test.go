@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestTagTemplateExpand(t *testing.T) {
+	specs := []*syncSpec{{name: "assets", bucket: "bucket", prefix: "current", dst: "/data"}}
+	results := []*syncResult{{resolvedPrefix: "releases/42/"}}
+	data := newTagData(time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC), v1.Hash{Algorithm: "sha256", Hex: "abcdef0123"}, specs, results)
+
+	tests := []struct {
+		template string
+		want     string
+		match    []string
+		mismatch []string
+	}{
+		{
+			template: `registry.example.com/repo:{{.Time.Format "20060102-150405"}}`,
+			want:     "registry.example.com/repo:20190102-030405",
+			match:    []string{"20190101-000000"},
+			mismatch: []string{"latest", "sha256-abcdef0123.sig", "2019-01-01"},
+		},
+		{
+			template: `repo:build-{{.Time.Format "2006-01-02T15:04:05Z"}}`,
+			want:     "index.docker.io/library/repo:build-2019-01-02T03-04-05Z",
+			mismatch: []string{"build-sha256-abcdef0123.att"},
+		},
+		{
+			template: `repo:{{.Time.Unix}}`,
+			want:     "index.docker.io/library/repo:1546398245",
+			mismatch: []string{"sha256-abcdef0123.sig"},
+		},
+		{
+			template: `localhost:5000/repo:{{.Spec.name}}-{{.ResolvedPrefix}}`,
+			want:     "localhost:5000/repo:assets-releases-42-",
+			match:    []string{"assets-releases-1-"},
+			mismatch: []string{"latest", "manual-releases-1-"},
+		},
+		{
+			template: `repo:v-{{.Digest.Hex}}`,
+			want:     "index.docker.io/library/repo:v-abcdef0123",
+			mismatch: []string{"v-"},
+		},
+		{
+			template: `repo:{{index .Specs.assets "resolved-prefix"}}`,
+			want:     "index.docker.io/library/repo:releases-42-",
+		},
+	}
+
+	for _, test := range tests {
+		tmpl, err := parseTagTemplate(test.template)
+		if err != nil {
+			t.Fatalf("template=%s: %v", test.template, err)
+		}
+		if err := tmpl.compile(specs); err != nil {
+			t.Fatalf("template=%s: %v", test.template, err)
+		}
+		tag, err := tmpl.expand(data)
+		if err != nil {
+			t.Fatalf("template=%s: %v", test.template, err)
+		}
+		if tag.String() != test.want {
+			t.Errorf("template=%s: got %s, want %s", test.template, tag, test.want)
+		}
+		for _, m := range append(test.match, tag.TagStr()) {
+			if !tmpl.pattern.MatchString(m) {
+				t.Errorf("template=%s: pattern does not match %s", test.template, m)
+			}
+		}
+		for _, m := range test.mismatch {
+			if tmpl.pattern.MatchString(m) {
+				t.Errorf("template=%s: pattern matches %s", test.template, m)
+			}
+		}
+	}
+
+	if _, err := parseTagTemplate(`{{.Spec.name}}/repo:tag`); err == nil {
+		t.Error("template without a static repository: got no error")
+	}
+}
+
+func TestTagTemplateSort(t *testing.T) {
+	tests := []struct {
+		template string
+		tags     []string
+		want     []string
+	}{
+		{
+			template: `repo:{{.Time.Format "2-1-2006"}}`,
+			tags:     []string{"9-1-2019", "10-1-2019", "1-2-2019"},
+			want:     []string{"1-2-2019", "10-1-2019", "9-1-2019"},
+		},
+		{
+			template: `repo:{{.Time.Unix}}`,
+			tags:     []string{"999999999", "1546398245"},
+			want:     []string{"1546398245", "999999999"},
+		},
+		{
+			template: `repo:{{.ResolvedPrefix}}`,
+			tags:     []string{"releases-1-", "releases-2-"},
+			want:     []string{"releases-2-", "releases-1-"},
+		},
+	}
+
+	for _, test := range tests {
+		tmpl, err := parseTagTemplate(test.template)
+		if err != nil {
+			t.Fatalf("template=%s: %v", test.template, err)
+		}
+		if err := tmpl.compile(nil); err != nil {
+			t.Fatalf("template=%s: %v", test.template, err)
+		}
+		tmpl.sort(test.tags)
+		if !reflect.DeepEqual(test.tags, test.want) {
+			t.Errorf("template=%s: got %v, want %v", test.template, test.tags, test.want)
+		}
+	}
+}
+
+func TestBuilderPruneTags(t *testing.T) {
+	registry := newTestRegistry()
+	defer registry.Close()
+
+	dst, err := ioutil.TempDir("", "tags_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	options := &builderOptions{
+		tags:         []string{registry.host() + `/repo:{{.Spec.name}}-{{.Time.Format "20060102-150405.000000000"}}`},
+		latestTags:   []string{"latest"},
+		tagRetention: 2,
+	}
+	b, err := newBuilder(options, []string{dst}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, l := range b.layers {
+			os.Remove(l.file)
+		}
+	}()
+	b.specs = []*syncSpec{{name: "assets", bucket: "bucket", prefix: "current", dst: dst}}
+	b.baseImages[""] = empty.Image
+
+	// The tags of the builds after the first one are newer than this.
+	var first string
+	for _, prefix := range []string{"releases/1/", "releases/2/", "releases/3/"} {
+		sources := []snapshotter{&staticSnapshot{path: dst, result: &syncResult{resolvedPrefix: prefix}}}
+		if err := b.build(context.Background(), sources); err != nil {
+			t.Fatal(err)
+		}
+		if first == "" {
+			first = "assets-" + time.Now().UTC().Format("20060102-150405.000000000")
+		}
+	}
+
+	repository, err := name.NewRepository(registry.host()+"/repo", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := remote.List(repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(tags)
+	if len(tags) != 3 || tags[0] < first || tags[1] < first || tags[2] != "latest" {
+		t.Errorf("tags: got %v, want the tags of the last 2 builds and latest", tags)
+	}
+	want := tags
+
+	// An expired tag pointing at the manifest of a kept tag is not deleted
+	// along with it, and neither are the tags pushed by hand that the
+	// template does not expand to.
+	latest, err := name.NewTag(registry.host()+"/repo:latest", name.WeakValidation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := remote.Image(latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := random.Image(10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed := map[string]v1.Image{
+		"assets-20190101-000000.000000000": image,
+		"sha256-abcdef0123.sig":            image,
+		"latest-manual":                    other,
+		"manual-20190101-000000.000000000": other,
+	}
+	for n, image := range pushed {
+		tag, err := name.NewTag(registry.host()+"/repo:"+n, name.WeakValidation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(tag, image); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.pruneTags(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if tags, err = remote.List(repository); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(tags)
+
+	for n := range pushed {
+		want = append(want, n)
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags: got %v, want %v", tags, want)
+	}
+}
+
+func TestNewBuilderTagRetention(t *testing.T) {
+	for _, tag := range []string{"repo:{{.Spec.name}}", "repo:build-{{.ResolvedPrefix}}"} {
+		options := &builderOptions{tags: []string{tag}, tagRetention: 1}
+		if _, err := newBuilder(options, nil, nil, nil); err == nil {
+			t.Errorf("tag template %s: got no error", tag)
+		}
+	}
+}